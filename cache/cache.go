@@ -0,0 +1,176 @@
+// Package cache implements a memory-budgeted in-RAM cache of file content
+// blocks shared by all open files.
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Key identifies a block of a file.
+type Key struct {
+	FileID string
+	Index  int64
+}
+
+type entry struct {
+	key  Key
+	data []byte
+}
+
+// Stats is a snapshot of the cache counters.
+type Stats struct {
+	Hits, Misses, Evictions uint64
+	Blocks                  int
+	Size, Budget            int64
+}
+
+// HitRatio returns the fraction of lookups served from the cache.
+func (s Stats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// BlockCache is an LRU cache of blocks holding at most budget bytes.
+// Blocks are tagged with the version of the file they were read from, and
+// all blocks of a file are dropped once it is seen with another version.
+type BlockCache struct {
+	mu       sync.Mutex
+	budget   int64
+	size     int64
+	lru      *list.List // front is the most recently used
+	files    map[string]map[int64]*list.Element
+	versions map[string]string
+	stats    Stats
+}
+
+// New returns a cache holding at most budget bytes.
+func New(budget int64) *BlockCache {
+	return &BlockCache{
+		budget:   budget,
+		lru:      list.New(),
+		files:    make(map[string]map[int64]*list.Element),
+		versions: make(map[string]string),
+	}
+}
+
+// Get returns the block for k if it is cached for the given file version.
+func (c *BlockCache) Get(k Key, version string) ([]byte, bool) {
+	return c.get(k, version, true)
+}
+
+// Peek is like Get but leaves the hit and miss counts alone, for lookups
+// of blocks that are not read yet, such as prefetches.
+func (c *BlockCache) Peek(k Key, version string) ([]byte, bool) {
+	return c.get(k, version, false)
+}
+
+func (c *BlockCache) get(k Key, version string, count bool) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checkVersion(k.FileID, version)
+	e, ok := c.files[k.FileID][k.Index]
+	if !ok {
+		if count {
+			c.stats.Misses++
+		}
+		return nil, false
+	}
+	if count {
+		c.stats.Hits++
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*entry).data, true
+}
+
+// Put caches the block for k read from the given file version, evicting
+// the least recently used blocks to stay within the budget.
+func (c *BlockCache) Put(k Key, version string, data []byte) {
+	if int64(len(data)) > c.Budget() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checkVersion(k.FileID, version)
+	if e, ok := c.files[k.FileID][k.Index]; ok {
+		c.remove(e)
+	}
+	blocks, ok := c.files[k.FileID]
+	if !ok {
+		blocks = make(map[int64]*list.Element)
+		c.files[k.FileID] = blocks
+	}
+	blocks[k.Index] = c.lru.PushFront(&entry{key: k, data: data})
+	c.size += int64(len(data))
+	c.evict()
+}
+
+// Invalidate drops all cached blocks of a file.
+func (c *BlockCache) Invalidate(fileID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidate(fileID)
+}
+
+// SetBudget changes the number of bytes the cache may hold, evicting
+// blocks right away if it shrinks.
+func (c *BlockCache) SetBudget(budget int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.budget = budget
+	c.evict()
+}
+
+func (c *BlockCache) Budget() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.budget
+}
+
+func (c *BlockCache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Blocks = c.lru.Len()
+	s.Size = c.size
+	s.Budget = c.budget
+	return s
+}
+
+// checkVersion drops the blocks of a file cached for another version.
+func (c *BlockCache) checkVersion(fileID, version string) {
+	if v, ok := c.versions[fileID]; ok && v == version {
+		return
+	}
+	c.invalidate(fileID)
+	c.versions[fileID] = version
+}
+
+func (c *BlockCache) invalidate(fileID string) {
+	for _, e := range c.files[fileID] {
+		c.remove(e)
+	}
+	delete(c.files, fileID)
+	delete(c.versions, fileID)
+}
+
+func (c *BlockCache) evict() {
+	for c.size > c.budget {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *BlockCache) remove(e *list.Element) {
+	en := e.Value.(*entry)
+	c.lru.Remove(e)
+	c.size -= int64(len(en.data))
+	blocks := c.files[en.key.FileID]
+	delete(blocks, en.key.Index)
+	if len(blocks) == 0 {
+		delete(c.files, en.key.FileID)
+		delete(c.versions, en.key.FileID)
+	}
+}
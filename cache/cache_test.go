@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBlockCache_LRU(t *testing.T) {
+	c := New(30)
+	a, b, d := Key{"f1", 0}, Key{"f1", 1}, Key{"f2", 0}
+	c.Put(a, "v1", make([]byte, 10))
+	c.Put(b, "v1", make([]byte, 10))
+	c.Put(d, "v1", make([]byte, 10))
+	if _, ok := c.Get(a, "v1"); !ok { // a is now the most recently used
+		t.Fatalf("Get(%v) missed", a)
+	}
+	c.Put(Key{"f2", 1}, "v1", make([]byte, 10))
+
+	if _, ok := c.Get(b, "v1"); ok {
+		t.Errorf("Get(%v) hit, want least recently used block evicted", b)
+	}
+	if _, ok := c.Get(a, "v1"); !ok {
+		t.Errorf("Get(%v) missed, want recently used block kept", a)
+	}
+	s := c.Stats()
+	if s.Size != 30 || s.Blocks != 3 || s.Evictions != 1 || s.Hits != 2 || s.Misses != 1 {
+		t.Errorf("Stats() = %+v", s)
+	}
+}
+
+func TestBlockCache_Peek(t *testing.T) {
+	c := New(30)
+	k := Key{"f1", 0}
+	if _, ok := c.Peek(k, "v1"); ok {
+		t.Fatalf("Peek(%v) hit an empty cache", k)
+	}
+	c.Put(k, "v1", []byte("data"))
+	if data, ok := c.Peek(k, "v1"); !ok || !bytes.Equal(data, []byte("data")) {
+		t.Errorf("Peek(%v) = %q, %v", k, data, ok)
+	}
+	if s := c.Stats(); s.Hits != 0 || s.Misses != 0 {
+		t.Errorf("Stats() after Peek = %+v, want no hits or misses", s)
+	}
+}
+
+func TestBlockCache_VersionChange(t *testing.T) {
+	c := New(100)
+	k := Key{"f1", 0}
+	c.Put(k, "v1", []byte("old"))
+	c.Put(Key{"f1", 1}, "v1", []byte("old"))
+	if data, ok := c.Get(k, "v1"); !ok || !bytes.Equal(data, []byte("old")) {
+		t.Fatalf("Get(%v, v1) = %q, %v", k, data, ok)
+	}
+	if _, ok := c.Get(k, "v2"); ok {
+		t.Errorf("Get(%v, v2) hit a block cached for v1", k)
+	}
+	if s := c.Stats(); s.Size != 0 || s.Blocks != 0 {
+		t.Errorf("Stats() after version change = %+v, want empty", s)
+	}
+}
+
+func TestBlockCache_SetBudget(t *testing.T) {
+	c := New(100)
+	for i := int64(0); i < 5; i++ {
+		c.Put(Key{"f1", i}, "v1", make([]byte, 20))
+	}
+	c.SetBudget(40)
+	if s := c.Stats(); s.Size != 40 || s.Blocks != 2 {
+		t.Errorf("Stats() after SetBudget(40) = %+v", s)
+	}
+	if _, ok := c.Get(Key{"f1", 4}, "v1"); !ok {
+		t.Errorf("newest block evicted by SetBudget")
+	}
+}
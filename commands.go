@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/althk/drivefs/driveapi"
+	"github.com/althk/drivefs/writeback"
+	"google.golang.org/api/drive/v3"
+)
+
+// runAuth authorizes drivefs and saves the token, replacing any token
+// there. A running mount whose token was revoked picks it up.
+func runAuth(ctx context.Context, o *options, args []string) error {
+	if o.credentialsPath == "" || o.tokenPath == "" || len(args) != 0 {
+		return errUsage
+	}
+	b, err := os.ReadFile(o.credentialsPath)
+	if err != nil {
+		return fmt.Errorf("unable to read credentials: %w", err)
+	}
+	store, err := newTokenStore(o)
+	if err != nil {
+		return err
+	}
+	if err := driveapi.Authorize(ctx, b, driveapi.AuthOptions{Store: store, Flow: o.authFlow}); err != nil {
+		return err
+	}
+	fmt.Printf("Token saved to %v\n", store)
+	return nil
+}
+
+func runUnmount(_ context.Context, _ *options, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	return unmount(arg(args, 0))
+}
+
+// runStatus prints the .drivefs/status of a mount, or the pending uploads
+// in the cache dir without one.
+func runStatus(_ context.Context, o *options, args []string) error {
+	switch len(args) {
+	case 0:
+		return printStatus(filepath.Join(o.cacheDir, "queue"))
+	case 1:
+		b, err := os.ReadFile(filepath.Join(arg(args, 0), ".drivefs", "status"))
+		if err != nil {
+			return fmt.Errorf("%v is not a drivefs mount: %w", arg(args, 0), err)
+		}
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return errUsage
+}
+
+func printStatus(dir string) error {
+	items, err := writeback.Pending(dir)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		fmt.Println("No pending uploads")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tQUEUED\tATTEMPTS\tLAST ERROR")
+	for _, it := range items {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\n", it.Target.Name, it.Size,
+			it.Queued.Format(time.RFC3339), it.Attempts, it.LastError)
+	}
+	return w.Flush()
+}
+
+// arg returns the i-th argument, or "" if there are not that many.
+func arg(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
+
+// session is a connection to Drive for the file commands.
+type session struct {
+	client *http.Client
+	svc    *drive.Service
+	root   driveapi.File
+}
+
+func connect(ctx context.Context, o *options) (*session, error) {
+	client, err := newClient(o)
+	if err != nil {
+		return nil, err
+	}
+	svc, err := newService(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	root, err := driveapi.Folder(ctx, svc, o.root)
+	if err != nil {
+		return nil, err
+	}
+	return &session{client: client, svc: svc, root: root}, nil
+}
+
+// lookup returns the Drive file at path, naming it in the error if there
+// is none.
+func lookup(ctx context.Context, root driveapi.File, p string) (driveapi.File, error) {
+	f, err := driveapi.Lookup(ctx, root, p)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", p, err)
+	}
+	return f, nil
+}
+
+// runLs lists a Drive folder, or a single file.
+func runLs(ctx context.Context, o *options, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	s, err := connect(ctx, o)
+	if err != nil {
+		return err
+	}
+	f, err := lookup(ctx, s.root, arg(args, 0))
+	if err != nil {
+		return err
+	}
+	files := []driveapi.File{f}
+	if f.IsDir() {
+		if files, err = f.ListFiles(ctx); err != nil {
+			return err
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, f := range files {
+		name, size := f.Name(), fmt.Sprint(f.Size())
+		if f.IsDir() {
+			name, size = name+"/", "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", size, f.ID(), name)
+	}
+	return w.Flush()
+}
+
+// runGet downloads a Drive file to a local file, named like it unless
+// given, or to stdout with "-".
+func runGet(ctx context.Context, o *options, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+	s, err := connect(ctx, o)
+	if err != nil {
+		return err
+	}
+	f, err := lookup(ctx, s.root, arg(args, 0))
+	if err != nil {
+		return err
+	}
+	if f.IsDir() || f.IsGoogleAppsFile() {
+		return fmt.Errorf("%v: only regular files can be downloaded", arg(args, 0))
+	}
+	dst := arg(args, 1)
+	if dst == "" {
+		dst = f.Name()
+	}
+	r, err := f.Download(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if dst == "-" {
+		_, err = io.Copy(os.Stdout, r)
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// runPut uploads a local file to a Drive path. If the path is a folder,
+// the file is uploaded into it under its local name.
+func runPut(ctx context.Context, o *options, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	src, dst := arg(args, 0), arg(args, 1)
+	s, err := connect(ctx, o)
+	if err != nil {
+		return err
+	}
+	journal, err := driveapi.NewJournal(filepath.Join(o.cacheDir, "uploads"))
+	if err != nil {
+		return err
+	}
+
+	target, err := driveapi.Lookup(ctx, s.root, dst)
+	if err == nil && target.IsDir() {
+		dst = path.Join(dst, filepath.Base(src))
+		target, err = driveapi.Lookup(ctx, s.root, dst)
+	}
+	if errors.Is(err, driveapi.ErrNotFound) {
+		dir, derr := lookup(ctx, s.root, path.Dir(dst))
+		if derr != nil {
+			return derr
+		}
+		if !dir.IsDir() {
+			return fmt.Errorf("%v: not a directory", path.Dir(dst))
+		}
+		target, err = dir.NewChild(path.Base(dst))
+	}
+	if err != nil {
+		return err
+	}
+	u := &driveapi.Uploader{
+		Client:     s.client,
+		Service:    s.svc,
+		ChunkSize:  o.chunkSize << 20,
+		Journal:    journal,
+		MaxRetries: 5,
+	}
+	if _, err := target.Upload(ctx, u, src, target.HeadRevisionID()); err != nil {
+		return err
+	}
+	fmt.Printf("%s\t%s\n", target.ID(), target.Name())
+	return nil
+}
+
+// runRm moves Drive files to the trash.
+func runRm(ctx context.Context, o *options, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	s, err := connect(ctx, o)
+	if err != nil {
+		return err
+	}
+	for _, p := range args {
+		f, err := lookup(ctx, s.root, p)
+		if err != nil {
+			return err
+		}
+		if f == s.root {
+			return errors.New("refusing to remove the root folder")
+		}
+		if err := driveapi.Trash(ctx, s.svc, f); err != nil {
+			return fmt.Errorf("%v: %w", p, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configFile is the drivefs configuration file, a JSON object such as:
+//
+//	{
+//		"default_profile": "work",
+//		"profiles": {
+//			"work": {
+//				"credsfile": "~/.config/drivefs/work-creds.json",
+//				"tokenfile": "~/.config/drivefs/work-token.json",
+//				"mntpoint": "/mnt/work",
+//				"readwrite": true,
+//				"cachesize": 512
+//			}
+//		}
+//	}
+//
+// The settings of a profile are named like the flags, and flags given on
+// the command line override them.
+type configFile struct {
+	DefaultProfile string                            `json:"default_profile"`
+	Profiles       map[string]map[string]interface{} `json:"profiles"`
+}
+
+// defaultConfigPath returns the path of the configuration file used when
+// -config is not given.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "drivefs", "config")
+}
+
+// loadConfig reads the configuration file at path. A missing file is an
+// empty configuration unless required.
+func loadConfig(path string, required bool) (*configFile, error) {
+	c := &configFile{}
+	if path == "" {
+		return c, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("unable to parse %v: %w", path, err)
+	}
+	return c, nil
+}
+
+// hasProfile reports whether the configuration defines the named profile.
+func (c *configFile) hasProfile(name string) bool {
+	_, ok := c.Profiles[name]
+	return ok
+}
+
+// apply sets the flags of fs not given on the command line to the settings
+// of the named profile. Settings that are flags of other commands are
+// ignored, as long as known is one of them.
+func (c *configFile) apply(name string, fs *flag.FlagSet, known func(string) bool) error {
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return fmt.Errorf("no profile %q in the configuration", name)
+	}
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	keys := make([]string, 0, len(profile))
+	for k := range profile {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if fs.Lookup(k) == nil {
+			if !known(k) {
+				return fmt.Errorf("unknown setting %q in profile %q", k, name)
+			}
+			continue
+		}
+		if given[k] {
+			continue
+		}
+		v, err := settingValue(profile[k])
+		if err != nil {
+			return fmt.Errorf("setting %q in profile %q: %w", k, name, err)
+		}
+		if err := fs.Set(k, v); err != nil {
+			return fmt.Errorf("setting %q in profile %q: %w", k, name, err)
+		}
+	}
+	return nil
+}
+
+// settingValue returns a JSON setting value as a flag value. A leading ~/
+// in strings stands for the home directory.
+func settingValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		if strings.HasPrefix(v, "~/") {
+			if home, err := os.UserHomeDir(); err == nil {
+				return filepath.Join(home, v[2:]), nil
+			}
+		}
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testConfig = `{
+	"default_profile": "home",
+	"profiles": {
+		"home": {"credsfile": "/etc/drivefs/home.json", "cachesize": 64},
+		"work": {"credsfile": "~/work.json", "mntpoint": "/mnt/work", "readwrite": true,
+			"cachesize": 512, "writemode": "sync"}
+	}
+}`
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// parse parses the command line of the mount command and applies the
+// configuration profile.
+func parse(t *testing.T, args ...string) (*options, []string, error) {
+	o := &options{}
+	fs := flag.NewFlagSet("drivefs mount", flag.ContinueOnError)
+	o.configFlags(fs)
+	o.mountFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	args = fs.Args()
+	err := applyProfile(&command{name: "mount"}, o, fs, &args)
+	return o, args, err
+}
+
+func TestApplyProfile(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, args, err := parse(t, "-config", path, "-cachesize", "1024", "work")
+	if err != nil {
+		t.Fatalf("applyProfile() error = %v", err)
+	}
+	if len(args) != 0 || o.profile != "work" {
+		t.Errorf("profile = %q, args = %q, want the work profile consumed", o.profile, args)
+	}
+	if o.mountPath != "/mnt/work" || !o.readWrite || o.writeMode != "sync" {
+		t.Errorf("options = %+v, want the settings of the work profile", o)
+	}
+	if o.cacheSize != 1024 {
+		t.Errorf("cachesize = %d, want 1024 from the command line", o.cacheSize)
+	}
+	if want := filepath.Join(home, "work.json"); o.credentialsPath != want {
+		t.Errorf("credsfile = %q, want %q", o.credentialsPath, want)
+	}
+	if o.values["cachesize"] != "1024" || o.values["mntpoint"] != "/mnt/work" {
+		t.Errorf("values = %v, want the applied settings", o.values)
+	}
+
+	// Without a profile, the default one is used and a mountpoint
+	// argument is left alone.
+	o, args, err = parse(t, "-config", path, "/mnt/home")
+	if err != nil {
+		t.Fatalf("applyProfile() error = %v", err)
+	}
+	if o.profile != "home" || o.cacheSize != 64 || len(args) != 1 {
+		t.Errorf("profile %q, cachesize %d, args %q, want the home profile and the mountpoint",
+			o.profile, o.cacheSize, args)
+	}
+}
+
+func TestApplyProfile_Errors(t *testing.T) {
+	if _, _, err := parse(t, "-config", writeConfig(t, testConfig), "-profile", "other"); err == nil {
+		t.Error("applyProfile() succeeded with a missing profile")
+	}
+	bad := writeConfig(t, `{"profiles": {"p": {"cachesise": 1}}}`)
+	if _, _, err := parse(t, "-config", bad, "-profile", "p"); err == nil {
+		t.Error("applyProfile() succeeded with an unknown setting")
+	}
+	if _, _, err := parse(t, "-config", filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("applyProfile() succeeded with a missing -config file")
+	}
+	if _, _, err := parse(t); err != nil {
+		t.Errorf("applyProfile() without a configuration error = %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/althk/drivefs/driveapi"
+)
+
+// daemonEnv is set in the environment of the background process started by
+// -daemon. It holds the file descriptor of the pipe on which the process
+// reports whether the mount succeeded.
+const daemonEnv = "DRIVEFS_DAEMON_FD"
+
+// daemonize starts drivefs again with the same arguments in the background,
+// detached from the terminal, and waits until it reports whether the mount
+// succeeded.
+func daemonize(o *options) error {
+	if o.tokenStore == "encrypted" && o.passphraseFD >= 0 {
+		// The file descriptor is not passed on, the passphrase is, and
+		// runMount ignores -passphrase-fd in the background.
+		passphrase, err := readPassphrase(o.passphraseFD)
+		if err != nil {
+			return err
+		}
+		os.Setenv(passphraseEnv, string(passphrase))
+		o.passphraseFD = -1
+	}
+	// The background process cannot ask the user to authorize drivefs, so
+	// it must already be.
+	if err := checkAuthorized(o); err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer null.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	// Keep the name it was run by, which tells the mount helper apart.
+	cmd.Args[0] = os.Args[0]
+	cmd.Env = append(os.Environ(), daemonEnv+"=3")
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = null, null, null
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	// The process is not waited for, it outlives this one.
+	cmd.Process.Release()
+
+	status, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	status = strings.TrimSpace(status)
+	switch {
+	case status == "ok":
+		return nil
+	case status == "":
+		return fmt.Errorf("drivefs exited before mounting, see %v", o.logFile)
+	}
+	return errors.New(strings.TrimPrefix(status, "error: "))
+}
+
+// checkAuthorized fails with driveapi.ErrNotAuthorized if drivefs has no
+// usable token to call Drive with, and would have to ask the user for one.
+func checkAuthorized(o *options) error {
+	if o.credentialsPath == "" {
+		return errUsage
+	}
+	b, err := os.ReadFile(o.credentialsPath)
+	if err != nil {
+		return fmt.Errorf("unable to read credentials: %w", err)
+	}
+	if driveapi.IsServiceAccount(b) {
+		return nil
+	}
+	if o.tokenPath == "" {
+		return errors.New("-tokenfile is required unless -credsfile is a service account key")
+	}
+	store, err := newTokenStore(o)
+	if err != nil {
+		return err
+	}
+	tok, err := store.Load()
+	if errors.Is(err, driveapi.ErrNoToken) || err == nil && tok.RefreshToken == "" && !tok.Valid() {
+		return driveapi.ErrNotAuthorized
+	}
+	return err
+}
+
+var (
+	// daemonized is set in the background process started by -daemon.
+	daemonized bool
+	// daemonPipe is where that process reports whether the mount
+	// succeeded, nil once it did.
+	daemonPipe *os.File
+)
+
+func init() {
+	if fd, err := strconv.Atoi(os.Getenv(daemonEnv)); err == nil {
+		daemonized = true
+		daemonPipe = os.NewFile(uintptr(fd), "daemon")
+		os.Unsetenv(daemonEnv)
+	}
+}
+
+// isDaemon reports whether this is the background process started by
+// -daemon.
+func isDaemon() bool {
+	return daemonized
+}
+
+// reportMounted tells the process that started this one by -daemon whether
+// the mount succeeded. Only the first report is sent.
+func reportMounted(err error) {
+	if daemonPipe == nil {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(daemonPipe, "error: %s\n", strings.ReplaceAll(err.Error(), "\n", " "))
+	} else {
+		fmt.Fprintln(daemonPipe, "ok")
+	}
+	daemonPipe.Close()
+	daemonPipe = nil
+}
+
+// writePidFile writes the process ID to path, failing if another running
+// process holds it.
+func writePidFile(path string) error {
+	if b, err := os.ReadFile(path); err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil && processExists(pid) {
+			return fmt.Errorf("drivefs is already running with pid %d, as recorded in %v", pid, path)
+		}
+	}
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// processExists reports whether a process with the given ID runs.
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/althk/drivefs/driveapi"
+	"golang.org/x/oauth2"
+)
+
+func TestCheckAuthorized(t *testing.T) {
+	dir := t.TempDir()
+	creds := filepath.Join(dir, "creds.json")
+	err := os.WriteFile(creds, []byte(`{"installed": {"client_id": "id", "client_secret": "secret",
+		"auth_uri": "https://example.com/auth", "token_uri": "https://example.com/token"}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &options{credentialsPath: creds, tokenPath: filepath.Join(dir, "token.json"),
+		tokenStore: "file", passphraseFD: -1}
+
+	if err := checkAuthorized(o); !errors.Is(err, driveapi.ErrNotAuthorized) {
+		t.Errorf("checkAuthorized() without a token error = %v, want ErrNotAuthorized", err)
+	}
+	// An expired token without a refresh token is no better.
+	store := driveapi.NewFileTokenStore(o.tokenPath)
+	if err := store.Save(&oauth2.Token{AccessToken: "a", Expiry: time.Now().Add(-time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkAuthorized(o); !errors.Is(err, driveapi.ErrNotAuthorized) {
+		t.Errorf("checkAuthorized() with an expired token error = %v, want ErrNotAuthorized", err)
+	}
+	if err := store.Save(&oauth2.Token{AccessToken: "a", RefreshToken: "r"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkAuthorized(o); err != nil {
+		t.Errorf("checkAuthorized() with a token error = %v", err)
+	}
+}
@@ -0,0 +1,348 @@
+package driveapi
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+)
+
+// ErrImpersonationUnsupported is returned when asked to impersonate a user
+// with credentials other than a service account key.
+var ErrImpersonationUnsupported = errors.New(
+	"impersonating a user requires service account credentials")
+
+const serviceAccountType = "service_account"
+
+// IsServiceAccount reports whether the credentials JSON in b is a service
+// account key, as opposed to an OAuth client ID.
+func IsServiceAccount(b []byte) bool {
+	var creds struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(b, &creds) == nil && creds.Type == serviceAccountType
+}
+
+// serviceAccountClient returns an HTTP client authorized as the service
+// account whose key is in b. If subject is set, the client acts as that
+// user instead, which requires domain-wide delegation to be granted to the
+// service account.
+func serviceAccountClient(b []byte, subject string) (*http.Client, error) {
+	config, err := google.JWTConfigFromJSON(b, drive.DriveScope)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse service account key: %w", err)
+	}
+	config.Subject = subject
+	logger.Info("authenticating with a service account", "account", config.Email,
+		"subject", subject)
+	return config.Client(context.Background()), nil
+}
+
+// The ways a user can be asked to authorize drivefs with an OAuth client
+// ID.
+const (
+	// FlowLoopback prints a link to open in a browser and catches the
+	// redirect back with a listener on 127.0.0.1.
+	FlowLoopback = "loopback"
+	// FlowDevice prints a code to enter at a link on any other device, and
+	// polls until the user has done so.
+	FlowDevice = "device"
+	// FlowNone fails with ErrNotAuthorized instead of asking the user, for
+	// processes that cannot interact with them.
+	FlowNone = "none"
+)
+
+// ErrNotAuthorized is returned when drivefs has no token and may not ask
+// the user for one.
+var ErrNotAuthorized = errors.New("drivefs is not authorized, run drivefs auth first")
+
+// deviceAuthURL is the device authorization endpoint of Google.
+const deviceAuthURL = "https://oauth2.googleapis.com/device/code"
+
+// AuthOptions configures how NewClient authorizes its requests.
+type AuthOptions struct {
+	// TokenPath is the file the OAuth token of the user is kept in as
+	// plain JSON, unless Store is set.
+	TokenPath string
+	// Store keeps the OAuth token of the user.
+	Store TokenStore
+	// Subject is the user a service account acts as, if any.
+	Subject string
+	// Flow is how the user is asked to authorize drivefs when there is no
+	// token yet: FlowLoopback, the default, or FlowDevice.
+	Flow string
+}
+
+func (o AuthOptions) store() TokenStore {
+	if o.Store != nil {
+		return o.Store
+	}
+	return NewFileTokenStore(o.TokenPath)
+}
+
+// authorize asks the user to authorize drivefs through flow and returns
+// the token granted.
+func authorize(ctx context.Context, config *oauth2.Config, flow string) (*oauth2.Token, error) {
+	switch flow {
+	case "", FlowLoopback:
+		return loopbackToken(ctx, config, func(authURL string) {
+			fmt.Printf("Open the below link in your browser to authorize drivefs:\n%v\n", authURL)
+		})
+	case FlowDevice:
+		return deviceToken(ctx, config, deviceAuthURL, func(verifyURL, code string) {
+			fmt.Printf("On any device, open %v and enter the code %v\n", verifyURL, code)
+		})
+	case FlowNone:
+		return nil, ErrNotAuthorized
+	}
+	return nil, fmt.Errorf("unknown authorization flow %q", flow)
+}
+
+// loopbackToken runs the OAuth authorization code flow with a loopback
+// redirect: prompt is given the link the user must open, and the code is
+// caught by a listener on 127.0.0.1 when the browser is redirected back.
+// The code is bound to the request with PKCE.
+func loopbackToken(ctx context.Context, config *oauth2.Config, prompt func(authURL string)) (*oauth2.Token, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen for the authorization redirect: %w", err)
+	}
+	defer l.Close()
+	c := *config
+	c.RedirectURL = "http://" + l.Addr().String() + "/"
+
+	state, verifier := randomString(), randomString()
+	sum := sha256.Sum256([]byte(verifier))
+	authURL := c.AuthCodeURL(state, oauth2.AccessTypeOffline,
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(sum[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+
+	type result struct {
+		code string
+		err  error
+	}
+	results := make(chan result, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("state") != state {
+			http.Error(w, "unexpected state", http.StatusBadRequest)
+			return
+		}
+		res := result{code: q.Get("code")}
+		if e := q.Get("error"); e != "" || res.code == "" {
+			res.err = fmt.Errorf("authorization denied: %s", e)
+			fmt.Fprintln(w, "drivefs was not authorized. You can close this window.")
+		} else {
+			fmt.Fprintln(w, "drivefs is authorized. You can close this window.")
+		}
+		select {
+		case results <- res:
+		default:
+		}
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	prompt(authURL)
+	select {
+	case res := <-results:
+		if res.err != nil {
+			return nil, res.err
+		}
+		tok, err := c.Exchange(ctx, res.code, oauth2.SetAuthURLParam("code_verifier", verifier))
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve token: %w", err)
+		}
+		return tok, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// deviceToken runs the OAuth device authorization flow (RFC 8628) against
+// the device authorization endpoint at deviceURL: prompt is given the link
+// the user must open on another device and the code to enter there, and
+// the token endpoint is polled until the user is done. Google rejects the
+// full Drive scope in this flow, so drive.file is requested instead, which
+// only grants access to the files drivefs creates.
+func deviceToken(ctx context.Context, config *oauth2.Config, deviceURL string,
+	prompt func(verifyURL, userCode string)) (*oauth2.Token, error) {
+	var auth struct {
+		DeviceCode string `json:"device_code"`
+		UserCode   string `json:"user_code"`
+		// Google names it verification_url, RFC 8628 verification_uri.
+		VerificationURL string `json:"verification_url"`
+		VerificationURI string `json:"verification_uri"`
+		ExpiresIn       int    `json:"expires_in"`
+		Interval        int    `json:"interval"`
+	}
+	err := postForm(ctx, deviceURL, url.Values{
+		"client_id": {config.ClientID},
+		"scope":     {strings.Join(deviceScopes(config.Scopes), " ")},
+	}, &auth)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start device authorization: %w", err)
+	}
+	if auth.VerificationURL == "" {
+		auth.VerificationURL = auth.VerificationURI
+	}
+	interval := time.Duration(auth.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second)
+	prompt(auth.VerificationURL, auth.UserCode)
+
+	for {
+		if err := sleep(ctx, interval); err != nil {
+			return nil, err
+		}
+		var res struct {
+			AccessToken  string `json:"access_token"`
+			TokenType    string `json:"token_type"`
+			RefreshToken string `json:"refresh_token"`
+			ExpiresIn    int    `json:"expires_in"`
+		}
+		err := postForm(ctx, config.Endpoint.TokenURL, url.Values{
+			"client_id":     {config.ClientID},
+			"client_secret": {config.ClientSecret},
+			"device_code":   {auth.DeviceCode},
+			"grant_type":    {"urn:ietf:params:oauth:grant-type:device_code"},
+		}, &res)
+		var oerr *oauthError
+		switch {
+		case err == nil:
+			tok := &oauth2.Token{
+				AccessToken:  res.AccessToken,
+				TokenType:    res.TokenType,
+				RefreshToken: res.RefreshToken,
+			}
+			if res.ExpiresIn > 0 {
+				tok.Expiry = time.Now().Add(time.Duration(res.ExpiresIn) * time.Second)
+			}
+			return tok, nil
+		case errors.As(err, &oerr) && oerr.Code == "authorization_pending":
+		case errors.As(err, &oerr) && oerr.Code == "slow_down":
+			interval += 5 * time.Second
+		default:
+			return nil, fmt.Errorf("device authorization failed: %w", err)
+		}
+		if auth.ExpiresIn > 0 && time.Now().After(deadline) {
+			return nil, errors.New("device authorization expired before the user was done")
+		}
+	}
+}
+
+// deviceScopes returns scopes with the full Drive scope, which the device
+// flow does not allow, replaced by drive.file.
+func deviceScopes(scopes []string) []string {
+	var res []string
+	for _, s := range scopes {
+		if s == drive.DriveScope {
+			s = drive.DriveFileScope
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// tokenInfoURL is the endpoint of Google describing an access token.
+const tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+
+// ErrFileScopeOnly is returned by CheckScope when the token only grants
+// the drive.file scope, as tokens from the device flow do.
+var ErrFileScopeOnly = errors.New("the token only grants access to the files drivefs created " +
+	"(drive.file scope), as tokens from -authflow device do, so the mount would look empty; " +
+	"authorize with -authflow loopback, on another machine or through an SSH tunnel if need be")
+
+// CheckScope fails with ErrFileScopeOnly if client, as returned by
+// NewClient, calls Drive with a token lacking the full Drive scope.
+func CheckScope(ctx context.Context, client *http.Client) error {
+	return checkScope(ctx, client, tokenInfoURL)
+}
+
+func checkScope(ctx context.Context, client *http.Client, infoURL string) error {
+	t, ok := client.Transport.(*oauth2.Transport)
+	if !ok {
+		return nil
+	}
+	tok, err := t.Source.Token()
+	if err != nil {
+		return err
+	}
+	var info struct {
+		Scope string `json:"scope"`
+	}
+	err = postForm(ctx, infoURL, url.Values{"access_token": {tok.AccessToken}}, &info)
+	if err != nil {
+		return fmt.Errorf("unable to look up the token scope: %w", err)
+	}
+	for _, s := range strings.Fields(info.Scope) {
+		if s == drive.DriveScope {
+			return nil
+		}
+	}
+	return ErrFileScopeOnly
+}
+
+// oauthError is an error response of an OAuth endpoint.
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *oauthError) Error() string {
+	if e.Description != "" {
+		return e.Code + ": " + e.Description
+	}
+	return e.Code
+}
+
+// postForm posts a form to an OAuth endpoint and decodes the JSON response
+// into v, or returns the *oauthError it reports.
+func postForm(ctx context.Context, endpoint string, form url.Values, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		oerr := &oauthError{}
+		if json.Unmarshal(body, oerr) != nil || oerr.Code == "" {
+			return fmt.Errorf("%s: %s", res.Status, body)
+		}
+		return oerr
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,271 @@
+package driveapi
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
+)
+
+// serviceAccountKey returns a service account key JSON whose tokens are
+// issued by tokenURL.
+func serviceAccountKey(t *testing.T, tokenURL string) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "ci@project.iam.gserviceaccount.com",
+		"private_key_id": "k1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":      tokenURL,
+	})
+	return b
+}
+
+func TestNewClient_ServiceAccount(t *testing.T) {
+	var subject string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			// The assertion is a JWT whose claims name the impersonated user.
+			r.ParseForm()
+			parts := strings.Split(r.Form.Get("assertion"), ".")
+			payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+			var claims struct {
+				Sub string `json:"sub"`
+			}
+			json.Unmarshal(payload, &claims)
+			subject = claims.Sub
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token": "sa-token", "token_type": "Bearer", "expires_in": 3600}`)
+			return
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer sa-token" {
+			t.Errorf("Authorization = %q, want the service account token", got)
+		}
+	}))
+	defer srv.Close()
+	key := serviceAccountKey(t, srv.URL+"/token")
+
+	if !IsServiceAccount(key) {
+		t.Fatal("IsServiceAccount() = false for a service account key")
+	}
+	client, err := NewClient(key, AuthOptions{Subject: "user@example.com"})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	res, err := client.Get(srv.URL + "/files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if subject != "user@example.com" {
+		t.Errorf("token requested for subject %q, want %q", subject, "user@example.com")
+	}
+}
+
+func TestNewClient_ImpersonateWithOAuthClient(t *testing.T) {
+	creds := []byte(`{"installed": {"client_id": "id", "client_secret": "secret",
+		"auth_uri": "https://accounts.google.com/o/oauth2/auth",
+		"token_uri": "https://oauth2.googleapis.com/token"}}`)
+	if IsServiceAccount(creds) {
+		t.Error("IsServiceAccount() = true for an OAuth client ID")
+	}
+	if _, err := NewClient(creds, AuthOptions{Subject: "user@example.com"}); err != ErrImpersonationUnsupported {
+		t.Errorf("NewClient() error = %v, want ErrImpersonationUnsupported", err)
+	}
+}
+
+// fakeAuthServer is an OAuth authorization server granting the token
+// "tok" for the code "code", or through the device flow after one pending
+// poll.
+func fakeAuthServer() *httptest.Server {
+	polls := 0
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/device":
+			if r.Form.Get("scope") != drive.DriveFileScope {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error": "invalid_scope"}`)
+				return
+			}
+			fmt.Fprint(w, `{"device_code": "dev", "user_code": "ABCD-EFGH",
+				"verification_url": "https://example.com/device", "expires_in": 60, "interval": 1}`)
+		case "/token":
+			switch r.Form.Get("grant_type") {
+			case "authorization_code":
+				if r.Form.Get("code") != "code" || r.Form.Get("code_verifier") == "" {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprint(w, `{"error": "invalid_grant"}`)
+					return
+				}
+			case "urn:ietf:params:oauth:grant-type:device_code":
+				if polls++; polls == 1 {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprint(w, `{"error": "authorization_pending"}`)
+					return
+				}
+			}
+			fmt.Fprint(w, `{"access_token": "tok", "token_type": "Bearer",
+				"refresh_token": "refresh", "expires_in": 3600}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func fakeAuthConfig(srv *httptest.Server) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     "id",
+		ClientSecret: "secret",
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  srv.URL + "/auth",
+			TokenURL: srv.URL + "/token",
+		},
+		Scopes: []string{drive.DriveScope},
+	}
+}
+
+func TestLoopbackToken(t *testing.T) {
+	srv := fakeAuthServer()
+	defer srv.Close()
+
+	// The prompt plays the browser: the user approves right away and is
+	// redirected back with the code.
+	browse := func(authURL string) {
+		u, err := url.Parse(authURL)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		q := u.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+			t.Errorf("authorization URL %s has no PKCE challenge", authURL)
+		}
+		redirect := q.Get("redirect_uri") + "?code=code&state=" + url.QueryEscape(q.Get("state"))
+		if !strings.HasPrefix(redirect, "http://127.0.0.1:") {
+			t.Errorf("redirect_uri = %q, want a loopback address", q.Get("redirect_uri"))
+		}
+		go func() {
+			res, err := http.Get(redirect)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res.Body.Close()
+		}()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tok, err := loopbackToken(ctx, fakeAuthConfig(srv), browse)
+	if err != nil {
+		t.Fatalf("loopbackToken() error = %v", err)
+	}
+	if tok.AccessToken != "tok" || tok.RefreshToken != "refresh" {
+		t.Errorf("loopbackToken() = %+v, want tok and refresh", tok)
+	}
+}
+
+func TestLoopbackToken_Denied(t *testing.T) {
+	srv := fakeAuthServer()
+	defer srv.Close()
+
+	deny := func(authURL string) {
+		u, _ := url.Parse(authURL)
+		q := u.Query()
+		go func() {
+			res, err := http.Get(q.Get("redirect_uri") + "?error=access_denied&state=" +
+				url.QueryEscape(q.Get("state")))
+			if err == nil {
+				res.Body.Close()
+			}
+		}()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := loopbackToken(ctx, fakeAuthConfig(srv), deny); err == nil {
+		t.Error("loopbackToken() succeeded after the user denied access")
+	}
+}
+
+func TestDeviceToken(t *testing.T) {
+	srv := fakeAuthServer()
+	defer srv.Close()
+
+	var gotURL, gotCode string
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tok, err := deviceToken(ctx, fakeAuthConfig(srv), srv.URL+"/device", func(verifyURL, code string) {
+		gotURL, gotCode = verifyURL, code
+	})
+	if err != nil {
+		t.Fatalf("deviceToken() error = %v", err)
+	}
+	if gotURL != "https://example.com/device" || gotCode != "ABCD-EFGH" {
+		t.Errorf("prompted with %q and %q", gotURL, gotCode)
+	}
+	if tok.AccessToken != "tok" || tok.Expiry.IsZero() {
+		t.Errorf("deviceToken() = %+v, want tok with an expiry", tok)
+	}
+}
+
+func TestAuthorize_FlowNone(t *testing.T) {
+	srv := fakeAuthServer()
+	defer srv.Close()
+	if _, err := authorize(context.TODO(), fakeAuthConfig(srv), FlowNone); err != ErrNotAuthorized {
+		t.Errorf("authorize() with FlowNone error = %v, want ErrNotAuthorized", err)
+	}
+}
+
+func TestCheckScope(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.FormValue("access_token") {
+		case "full":
+			fmt.Fprintf(w, `{"scope": "openid %s"}`, drive.DriveScope)
+		case "file":
+			fmt.Fprintf(w, `{"scope": "%s"}`, drive.DriveFileScope)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_token"}`)
+		}
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		token   string
+		wantErr error
+	}{
+		{"full", nil},
+		{"file", ErrFileScopeOnly},
+	} {
+		client := oauth2.NewClient(context.TODO(), oauth2.StaticTokenSource(&oauth2.Token{AccessToken: tt.token}))
+		if err := checkScope(context.TODO(), client, srv.URL); err != tt.wantErr {
+			t.Errorf("checkScope() with a %s token error = %v, want %v", tt.token, err, tt.wantErr)
+		}
+	}
+	client := oauth2.NewClient(context.TODO(), oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "bad"}))
+	if err := checkScope(context.TODO(), client, srv.URL); err == nil || errors.Is(err, ErrFileScopeOnly) {
+		t.Errorf("checkScope() with a rejected token error = %v, want a lookup error", err)
+	}
+}
@@ -0,0 +1,107 @@
+package driveapi
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CallCounter is an http.RoundTripper counting the requests sent to Drive
+// by API method, and how many of them failed. The requests are also
+// counted in the drivefs_drive_api_calls_total metric.
+type CallCounter struct {
+	// Base sends the requests. http.DefaultTransport is used if nil.
+	Base http.RoundTripper
+
+	mu     sync.Mutex
+	calls  map[string]int64
+	errors int64
+}
+
+// CallCount is the number of requests sent to a Drive API method, such as
+// files.list.
+type CallCount struct {
+	Method string
+	Calls  int64
+}
+
+func (c *CallCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := c.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	res, err := base.RoundTrip(req)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(res.StatusCode)
+	}
+	method := apiMethod(req)
+	apiCalls.Inc(method, status)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.calls == nil {
+		c.calls = make(map[string]int64)
+	}
+	c.calls[method]++
+	if err != nil || res.StatusCode >= 400 {
+		c.errors++
+	}
+	return res, err
+}
+
+// Counts returns the number of requests sent so far by method, sorted by
+// method, and the number of them that failed.
+func (c *CallCounter) Counts() (counts []CallCount, errors int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for m, n := range c.calls {
+		counts = append(counts, CallCount{Method: m, Calls: n})
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Method < counts[j].Method })
+	return counts, c.errors
+}
+
+// apiMethod names the Drive API method a request calls from its URL, as
+// resource.verb: files.list, files.get, revisions.list and so on. Content
+// downloads (alt=media) are named resource.download, and all the requests
+// of an upload, from starting the session to the last chunk, files.upload.
+func apiMethod(req *http.Request) string {
+	path, query := req.URL.Path, req.URL.Query()
+	if strings.HasPrefix(path, "/upload/") || query.Get("uploadType") != "" || query.Get("upload_id") != "" {
+		return "files.upload"
+	}
+	if i := strings.Index(path, "/drive/v3/"); i >= 0 {
+		path = path[i+len("/drive/v3/"):]
+	}
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	// Nested resources, such as files/{id}/revisions, are named by the
+	// innermost one.
+	resource := parts[(len(parts)-1)/2*2]
+	item := len(parts)%2 == 0
+	switch resource {
+	case "about":
+		return "about.get"
+	case "files", "revisions", "drives", "changes", "permissions", "comments", "replies":
+	default:
+		return "other"
+	}
+	switch req.Method {
+	case http.MethodGet:
+		switch {
+		case query.Get("alt") == "media":
+			return resource + ".download"
+		case item:
+			return resource + ".get"
+		}
+		return resource + ".list"
+	case http.MethodPost:
+		return resource + ".create"
+	case http.MethodPatch, http.MethodPut:
+		return resource + ".update"
+	case http.MethodDelete:
+		return resource + ".delete"
+	}
+	return "other"
+}
@@ -0,0 +1,62 @@
+package driveapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCallCounter(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	c := &CallCounter{}
+	client := &http.Client{Transport: c}
+	for _, call := range []struct{ method, path string }{
+		{http.MethodGet, "/drive/v3/files?q=x"},
+		{http.MethodGet, "/drive/v3/files?pageToken=p2"},
+		{http.MethodPatch, "/drive/v3/files/fid"},
+	} {
+		req, _ := http.NewRequest(call.method, srv.URL+call.path, nil)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	counts, errors := c.Counts()
+	want := []CallCount{{"files.list", 2}, {"files.update", 1}}
+	if len(counts) != 2 || counts[0] != want[0] || counts[1] != want[1] || errors != 1 {
+		t.Errorf("Counts() = %v, %d, want %v, 1", counts, errors, want)
+	}
+}
+
+func TestAPIMethod(t *testing.T) {
+	tests := []struct {
+		method, url, want string
+	}{
+		{"GET", "https://www.googleapis.com/drive/v3/files?q=x&alt=json", "files.list"},
+		{"GET", "https://www.googleapis.com/drive/v3/files/fid?fields=id", "files.get"},
+		{"GET", "https://www.googleapis.com/drive/v3/files/fid?alt=media", "files.download"},
+		{"PATCH", "https://www.googleapis.com/drive/v3/files/fid", "files.update"},
+		{"GET", "https://www.googleapis.com/drive/v3/files/fid/revisions", "revisions.list"},
+		{"GET", "https://www.googleapis.com/drive/v3/files/fid/revisions/r1?alt=media", "revisions.download"},
+		{"GET", "https://www.googleapis.com/drive/v3/about?fields=user", "about.get"},
+		{"GET", "https://www.googleapis.com/drive/v3/drives", "drives.list"},
+		{"POST", "https://www.googleapis.com/upload/drive/v3/files?uploadType=resumable", "files.upload"},
+		{"PATCH", "https://www.googleapis.com/upload/drive/v3/files/fid?uploadType=resumable", "files.upload"},
+		{"PUT", "https://www.googleapis.com/upload/drive/v3/files?uploadType=resumable&upload_id=u1", "files.upload"},
+		// Paths relative to an endpoint set with option.WithEndpoint.
+		{"GET", "http://127.0.0.1:8080/files/fid", "files.get"},
+		{"GET", "https://oauth2.googleapis.com/token", "other"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, tt.url, nil)
+		if got := apiMethod(req); got != tt.want {
+			t.Errorf("apiMethod(%s %s) = %q, want %q", tt.method, tt.url, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package driveapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+)
+
+// ErrChecksumMismatch is returned when downloaded content does not match
+// the checksum Drive reports for the file.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Verifier checks file content written to it against the sha256Checksum
+// reported by Drive, or the md5Checksum if the file has no sha256 one.
+// Google Apps files have no checksum, so any content passes for them.
+type Verifier struct {
+	file File
+	algo string
+	want string
+	h    hash.Hash
+}
+
+func NewVerifier(f File) *Verifier {
+	if sum := f.SHA256Checksum(); sum != "" {
+		return &Verifier{file: f, algo: "sha256", want: sum, h: sha256.New()}
+	}
+	return &Verifier{file: f, algo: "md5", want: f.MD5Checksum(), h: md5.New()}
+}
+
+func (v *Verifier) Write(p []byte) (int, error) {
+	return v.h.Write(p)
+}
+
+// Verify reports whether everything written so far is the file content.
+func (v *Verifier) Verify() error {
+	if v.want == "" {
+		return nil
+	}
+	if got := hex.EncodeToString(v.h.Sum(nil)); got != v.want {
+		logger.Error("checksum mismatch", "file", v.file.ID(), "name", v.file.Name(),
+			"algo", v.algo, "got", got, "want", v.want)
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// verifyingReader checks the content read through it once it reaches EOF.
+type verifyingReader struct {
+	r io.ReadCloser
+	v *Verifier
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	downloadedBytes.Add(float64(n))
+	r.v.Write(p[:n])
+	if err == io.EOF {
+		if verr := r.v.Verify(); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+func (r *verifyingReader) Close() error {
+	return r.r.Close()
+}
+
+// The Drive client library in use predates the sha256Checksum field and
+// drops it when decoding files. Calls made with a context from keepBody
+// keep their raw response body so that it can be read from there, as long
+// as the service was made by NewService, whose client passes responses
+// through bodyKeeper.
+type keptBodyKey struct{}
+
+type keptBody struct {
+	data []byte
+}
+
+// keepBody returns a context that makes the calls using it keep their
+// response body in the returned keptBody.
+func keepBody(ctx context.Context) (context.Context, *keptBody) {
+	kb := &keptBody{}
+	return context.WithValue(ctx, keptBodyKey{}, kb), kb
+}
+
+// sha256Checksums returns the sha256Checksum of the files in the kept
+// body, a file or a file list, by file ID.
+func (kb *keptBody) sha256Checksums() map[string]string {
+	type sum struct {
+		ID     string `json:"id"`
+		SHA256 string `json:"sha256Checksum"`
+	}
+	var res struct {
+		sum
+		Files []sum `json:"files"`
+	}
+	sums := make(map[string]string)
+	if err := json.Unmarshal(kb.data, &res); err != nil {
+		return sums
+	}
+	for _, s := range append(res.Files, res.sum) {
+		if s.SHA256 != "" {
+			sums[s.ID] = s.SHA256
+		}
+	}
+	return sums
+}
+
+// bodyKeeper is an http.RoundTripper that keeps the response body of the
+// requests made with a context from keepBody.
+type bodyKeeper struct {
+	base http.RoundTripper
+}
+
+func (t *bodyKeeper) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	kb, ok := req.Context().Value(keptBodyKey{}).(*keptBody)
+	if err != nil || !ok {
+		return resp, err
+	}
+	defer resp.Body.Close()
+	if kb.data, err = io.ReadAll(resp.Body); err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(kb.data))
+	return resp, nil
+}
@@ -0,0 +1,98 @@
+package driveapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/api/option"
+)
+
+const (
+	abcMD5    = "900150983cd24fb0d6963f7d28e17f72"
+	abcSHA256 = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+)
+
+func TestVerifier(t *testing.T) {
+	tests := []struct {
+		name    string
+		f       *file
+		wantErr error
+	}{
+		{"md5", &file{md5Checksum: abcMD5}, nil},
+		{"md5 mismatch", &file{md5Checksum: "0123"}, ErrChecksumMismatch},
+		// The sha256 checksum is preferred when there is one.
+		{"sha256", &file{md5Checksum: "0123", sha256Checksum: abcSHA256}, nil},
+		{"sha256 mismatch", &file{md5Checksum: abcMD5, sha256Checksum: "0123"}, ErrChecksumMismatch},
+		{"no checksum", &file{}, nil},
+	}
+	for _, tt := range tests {
+		v := NewVerifier(tt.f)
+		io.WriteString(v, "abc")
+		if err := v.Verify(); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: Verify() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestFile_ListFilesSHA256(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/files":
+			fmt.Fprintf(w, `{"files": [
+				{"id": "a", "name": "a.txt", "md5Checksum": "%s", "sha256Checksum": "%s"},
+				{"id": "b", "name": "b.txt", "md5Checksum": "%s"}]}`, abcMD5, abcSHA256, abcMD5)
+		case "/files/a":
+			if r.URL.Query().Get("alt") == "media" {
+				fmt.Fprint(w, "abd")
+				return
+			}
+			fmt.Fprintf(w, `{"id": "a", "name": "a.txt", "sha256Checksum": "%s"}`, abcSHA256)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	svc, err := NewService(context.TODO(), srv.Client(), option.WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := &file{GD: svc, id: "root", mimeType: GoogleAppsMimeTypeText(MimeTypeGoogleDriveFolder)}
+
+	files, err := dir.ListFiles(context.TODO())
+	if err != nil {
+		t.Fatalf("ListFiles() error = %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("ListFiles() = %v, want 2 files", files)
+	}
+	if got := files[0].SHA256Checksum(); got != abcSHA256 {
+		t.Errorf("SHA256Checksum() = %q, want %q", got, abcSHA256)
+	}
+	if got := files[1].SHA256Checksum(); got != "" {
+		t.Errorf("SHA256Checksum() of a file without one = %q, want empty", got)
+	}
+
+	// The content does not match the sha256 checksum.
+	rc, err := files[0].Download(context.TODO())
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	defer rc.Close()
+	if _, err := io.ReadAll(rc); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("reading the download error = %v, want ErrChecksumMismatch", err)
+	}
+
+	f := files[0].(*file)
+	f.sha256Checksum = ""
+	if err := f.refresh(context.TODO()); err != nil {
+		t.Fatalf("refresh() error = %v", err)
+	}
+	if got := f.SHA256Checksum(); got != abcSHA256 {
+		t.Errorf("SHA256Checksum() after refresh = %q, want %q", got, abcSHA256)
+	}
+}
@@ -2,19 +2,19 @@
 package driveapi
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"mime"
 	"net/http"
-	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/althk/drivefs/logging"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/drive/v3"
@@ -56,95 +56,165 @@ func GoogleAppsMimeTypeText(code int) string {
 	return googleAppsMimeTypes[code]
 }
 
+// Drive has two kinds of custom file properties, public ones visible to
+// all apps and private ones only visible to the app that set them.
+// See https://developers.google.com/drive/api/v3/properties
+const (
+	PropertyScopePublic = iota
+	PropertyScopePrivate
+)
+
+// fileFields is the set of fields fetched for every file.
+const fileFields = "id, name, size, parents, mimeType, md5Checksum, sha256Checksum, version, " +
+	"headRevisionId, description, properties, appProperties"
+
+// logger is where the package logs to. See SetLogger.
+var logger *logging.Logger
+
+// SetLogger sets the logger of the package. Nothing is logged until it is
+// set.
+func SetLogger(l *logging.Logger) {
+	logger = l
+}
+
 func InitWithConfigJSON(
-	ctx context.Context, b []byte, tokenPath string) *drive.Service {
-	config, err := google.ConfigFromJSON(b, drive.DriveScope)
+	ctx context.Context, b []byte, tokenPath string) (*drive.Service, error) {
+	client, err := NewClient(b, AuthOptions{TokenPath: tokenPath})
 	if err != nil {
-		log.Fatalf("Unable to parse config from json: %v", err)
+		return nil, err
+	}
+	return NewService(ctx, client)
+}
+
+// NewClient returns an HTTP client authorized to call the Drive API with
+// the credentials JSON in b, either a service account key or an OAuth
+// client ID, as told by its type.
+//
+// With a service account key, the client acts as opts.Subject through
+// domain-wide delegation if it is set, or else as the service account. With
+// an OAuth client ID, the client acts as the user whose token is kept at
+// opts.Store, asking them to authorize it through opts.Flow if needed.
+func NewClient(b []byte, opts AuthOptions) (*http.Client, error) {
+	if IsServiceAccount(b) {
+		return serviceAccountClient(b, opts.Subject)
 	}
-	client := getClient(config, tokenPath)
-	service, err := drive.NewService(ctx, option.WithHTTPClient(client))
+	if opts.Subject != "" {
+		return nil, ErrImpersonationUnsupported
+	}
+	config, err := google.ConfigFromJSON(b, drive.DriveScope)
 	if err != nil {
-		log.Fatalf("Unable to create Drive service: %v", err)
+		return nil, fmt.Errorf("unable to parse config from json: %w", err)
 	}
-	return service
+	return getClient(config, opts.store(), opts.Flow)
 }
 
-func RootFolder(ctx context.Context, drv *drive.Service) (File, error) {
-	root, err := drv.Files.Get("root").Context(ctx).
-		Fields("id, name").Do()
+func NewService(ctx context.Context, client *http.Client, opts ...option.ClientOption) (*drive.Service, error) {
+	c := *client
+	c.Transport = &bodyKeeper{base: client.Transport}
+	service, err := drive.NewService(ctx, append([]option.ClientOption{option.WithHTTPClient(&c)}, opts...)...)
 	if err != nil {
-		log.Fatalf("Error fetching root folder: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("unable to create Drive service: %w", err)
 	}
-	return &file{
-		GD:       drv,
-		id:       root.Id,
-		name:     root.Name,
-		files:    nil,
-		mimeType: GoogleAppsMimeTypeText(MimeTypeGoogleDriveFolder),
-	}, nil
+	return service, nil
 }
 
-func tokenFromFile(path string) (*oauth2.Token, error) {
-	f, err := os.Open(path)
+func RootFolder(ctx context.Context, drv *drive.Service) (File, error) {
+	root, err := drv.Files.Get("root").Context(ctx).Fields(rootFields).Do()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error fetching root folder: %w", err)
 	}
-	defer f.Close()
-	tok := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(tok)
-	return tok, err
+	return newRoot(drv, root), nil
 }
 
-func tokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("token-state", oauth2.AccessTypeOffline)
-	fmt.Printf("Open the below link in your browser and "+
-		"then type/paste the authorization code here:\n%v\n", authURL)
+// rootFields is the set of fields fetched for a folder used as a root.
+const rootFields = "id, name, mimeType, description, properties, appProperties"
 
-	var authzCode string
-	if _, err := fmt.Scan(&authzCode); err != nil {
-		log.Fatalf("Unable to read authorization code :%v", err)
+// newRoot returns a folder used as the root of a tree.
+func newRoot(drv *drive.Service, res *drive.File) *file {
+	return &file{
+		GD:            drv,
+		id:            res.Id,
+		name:          res.Name,
+		files:         nil,
+		mimeType:      GoogleAppsMimeTypeText(MimeTypeGoogleDriveFolder),
+		description:   res.Description,
+		properties:    res.Properties,
+		appProperties: res.AppProperties,
 	}
-	tok, err := config.Exchange(context.TODO(), authzCode)
+}
+
+// StorageQuota returns the storage limit and usage of the Drive account in
+// bytes. A limit of 0 means the account has unlimited storage.
+func StorageQuota(ctx context.Context, drv *drive.Service) (limit, usage uint64, err error) {
+	about, err := drv.About.Get().Context(ctx).Fields("storageQuota").Do()
 	if err != nil {
-		log.Fatalf("Unable to retrieve token from web: %v", err)
+		return 0, 0, err
+	}
+	if about.StorageQuota == nil {
+		return 0, 0, errors.New("storage quota missing from response")
 	}
-	return tok
+	return uint64(about.StorageQuota.Limit), uint64(about.StorageQuota.Usage), nil
 }
 
-func saveToken(path string, token *oauth2.Token) {
-	fmt.Printf("Saving token to file %v", path)
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+// Account returns the email address of the user the Drive service acts as.
+func Account(ctx context.Context, drv *drive.Service) (string, error) {
+	about, err := drv.About.Get().Context(ctx).Fields("user(emailAddress)").Do()
 	if err != nil {
-		log.Fatalf("Unable to save token to %v: %v\n", path, err)
+		return "", err
 	}
-	defer f.Close()
-
-	if err := json.NewEncoder(f).Encode(token); err != nil {
-		log.Fatalf("Unable to write token to file %v: %v\n", path, err)
+	if about.User == nil {
+		return "", errors.New("user missing from response")
 	}
+	return about.User.EmailAddress, nil
 }
 
-func getClient(config *oauth2.Config, tokenPath string) *http.Client {
-
-	tok, err := tokenFromFile(tokenPath)
-
+func getClient(config *oauth2.Config, store TokenStore, flow string) (*http.Client, error) {
+	tok, err := store.Load()
+	if errors.Is(err, ErrNoToken) {
+		if tok, err = authorize(context.Background(), config, flow); err == nil {
+			logger.Info("saving token", "store", store)
+			err = store.Save(tok)
+		}
+	}
 	if err != nil {
-		tok = tokenFromWeb(config)
-		saveToken(tokenPath, tok)
+		return nil, err
 	}
-	return config.Client(context.Background(), tok)
+	return oauth2.NewClient(context.Background(), newTokenSource(config, store, tok)), nil
 }
 
+// ErrNoProperty is returned when removing a custom property that the file
+// does not have.
+var ErrNoProperty = errors.New("no such property")
+
 type file struct {
-	GD                                       *drive.Service
-	id, name, mimeType, parentID, parentName string
-	size                                     uint64
-	content                                  []byte
-	files                                    []File
-	lsTime                                   time.Time
-	contentDownloaded                        bool
+	GD                         *drive.Service
+	name, parentID, parentName string
+
+	// mu guards the fields below, which change as the file is uploaded,
+	// refreshed or listed while FUSE reads them.
+	mu                          sync.Mutex
+	id, mimeType                string
+	size                        uint64
+	md5Checksum, sha256Checksum string
+	headRevisionID              string
+	version                     int64
+	files                       []File
+	description                 string
+	properties, appProperties   map[string]string
+	lsTime                      time.Time
+}
+
+// DefaultListTTL is how long folder listings are cached unless set
+// otherwise with SetListTTL.
+const DefaultListTTL = time.Hour
+
+// listTTL is how long folder listings are cached, in nanoseconds.
+var listTTL = int64(DefaultListTTL)
+
+// SetListTTL sets how long folder listings are cached before they are
+// fetched from Drive again. It applies to the listings already cached too.
+func SetListTTL(d time.Duration) {
+	atomic.StoreInt64(&listTTL, int64(d))
 }
 
 type File interface {
@@ -157,10 +227,24 @@ type File interface {
 	MimeType() string
 	ParentID() string
 	ParentName() string
-	Content() []byte
+	MD5Checksum() string
+	SHA256Checksum() string
+	Version() int64
+	HeadRevisionID() string
 	Files() []File
 	ID() string
 	Download(ctx context.Context) (io.ReadCloser, error)
+	DownloadHead(ctx context.Context) (io.ReadCloser, string, error)
+	DownloadRange(ctx context.Context, off, length int64) ([]byte, error)
+	NewChild(name string) (File, error)
+	Upload(ctx context.Context, u *Uploader, localPath, baseRevision string) (string, error)
+	Description() string
+	Properties(scope int) map[string]string
+	SetDescription(ctx context.Context, desc string) error
+	SetProperty(ctx context.Context, scope int, key, value string) error
+	RemoveProperty(ctx context.Context, scope int, key string) error
+	Revisions(ctx context.Context) ([]File, error)
+	Invalidate()
 }
 
 func (f *file) ListFiles(
@@ -168,30 +252,45 @@ func (f *file) ListFiles(
 	if !f.IsDir() {
 		return nil, errors.New("not a directory")
 	}
-	log.Printf("Listing files for %s", f.Name())
-	if time.Since(f.lsTime).Minutes() < 60 {
-		return f.files, nil
+	f.mu.Lock()
+	if time.Since(f.lsTime) < time.Duration(atomic.LoadInt64(&listTTL)) {
+		files := f.files
+		f.mu.Unlock()
+		return files, nil
 	}
+	f.mu.Unlock()
+	id := f.ID()
+	start := time.Now()
 	var nextPageToken string
 	var files []File
+	ctx, body := keepBody(ctx)
 	for {
 		res, err := f.GD.Files.List().Context(ctx).
-			Fields("nextPageToken, files(id, name, size, parents, mimeType)").
+			SupportsAllDrives(true).IncludeItemsFromAllDrives(true).
+			Fields("nextPageToken, files(" + fileFields + ")").
 			PageToken(nextPageToken).
-			Q(fmt.Sprintf("'%s' in parents", f.id)).
+			Q(fmt.Sprintf("'%s' in parents and trashed = false", id)).
 			Do()
 		if err != nil {
 			return files, err
 		}
+		sha256s := body.sha256Checksums()
 		for _, e := range res.Files {
 			files = append(files, &file{
-				id:         e.Id,
-				name:       e.Name,
-				parentID:   f.ID(),
-				parentName: f.Name(),
-				size:       uint64(e.Size),
-				mimeType:   e.MimeType,
-				GD:         f.GD,
+				id:             e.Id,
+				name:           e.Name,
+				parentID:       id,
+				parentName:     f.name,
+				size:           uint64(e.Size),
+				md5Checksum:    e.Md5Checksum,
+				sha256Checksum: sha256s[e.Id],
+				version:        e.Version,
+				headRevisionID: e.HeadRevisionId,
+				mimeType:       e.MimeType,
+				description:    e.Description,
+				properties:     e.Properties,
+				appProperties:  e.AppProperties,
+				GD:             f.GD,
 			})
 		}
 		if len(res.NextPageToken) == 0 {
@@ -199,26 +298,50 @@ func (f *file) ListFiles(
 		}
 		nextPageToken = res.NextPageToken
 	}
+	listed := make(map[string]bool, len(files))
+	for _, c := range files {
+		listed[c.Name()] = true
+	}
+	f.mu.Lock()
+	// Files added by NewChild stay listed until they are created on Drive.
+	for _, c := range f.files {
+		if c.ID() == "" && !listed[c.Name()] {
+			files = append(files, c)
+		}
+	}
 	f.files = files
 	f.lsTime = time.Now()
+	f.mu.Unlock()
+	logger.Debug("listed files", "op", "list", "file", id, "name", f.name,
+		"count", len(files), "latency", time.Since(start))
 	return files, nil
 }
 
+// Invalidate drops the cached listing of the directory, so that the next
+// ListFiles fetches it from Drive again.
+func (f *file) Invalidate() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lsTime = time.Time{}
+}
+
 func (f *file) String() string {
 	return fmt.Sprintf(
 		"%s/%s => mime type: %s, ID: %s, size: %d KB",
-		f.parentName, f.name, f.mimeType, f.id, f.size/1024)
+		f.parentName, f.name, f.MimeType(), f.ID(), f.Size()/1024)
 }
 
 func (f *file) IsDir() bool {
-	return f.mimeType == GoogleAppsMimeTypeText(MimeTypeGoogleDriveFolder)
+	return f.MimeType() == GoogleAppsMimeTypeText(MimeTypeGoogleDriveFolder)
 }
 
 func (f *file) IsGoogleAppsFile() bool {
-	return strings.HasPrefix(f.mimeType, "application/vnd.google-apps")
+	return strings.HasPrefix(f.MimeType(), "application/vnd.google-apps")
 }
 
 func (f *file) Size() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	return f.size
 }
 
@@ -227,10 +350,14 @@ func (f *file) Name() string {
 }
 
 func (f *file) ID() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	return f.id
 }
 
 func (f *file) MimeType() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	return f.mimeType
 }
 
@@ -242,38 +369,236 @@ func (f *file) ParentID() string {
 	return f.parentID
 }
 
-func (f *file) Content() []byte {
-	return f.content
+// MD5Checksum returns the checksum of the file content, which is empty for
+// Google Apps files.
+func (f *file) MD5Checksum() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.md5Checksum
+}
+
+// SHA256Checksum returns the sha256 checksum of the file content, which is
+// empty for Google Apps files and files Drive has not computed it for.
+func (f *file) SHA256Checksum() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sha256Checksum
+}
+
+// Version returns the version number of the file on Drive, which is bumped
+// on every change to the file.
+func (f *file) Version() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.version
+}
+
+// HeadRevisionID returns the ID of the current revision of the file
+// content, which unlike the version only changes when the content does.
+func (f *file) HeadRevisionID() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.headRevisionID
 }
 
 func (f *file) Files() []File {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	return f.files
 }
 
+// Download returns a reader for the full file content. The caller must
+// close it. The content is verified against the file checksum and the
+// reader returns ErrChecksumMismatch instead of io.EOF if it does not match.
 func (f *file) Download(ctx context.Context) (io.ReadCloser, error) {
-	if f.contentDownloaded { // TODO: add TTL logic here
-		return f.contentReader(), nil
-	}
-	r, err := f.GD.Files.Get(f.id).
+	r, err := f.GD.Files.Get(f.ID()).
 		Context(ctx).
+		SupportsAllDrives(true).
 		Download()
 	if err != nil {
-		fmt.Printf("error downloading %s: %v\n", f.name, err)
 		return nil, err
 	}
-	defer r.Body.Close()
-	fmt.Printf("file download started for %s\n", f.name)
-	data, err := io.ReadAll(r.Body)
+	return &verifyingReader{r: r.Body, v: NewVerifier(f)}, nil
+}
+
+// DownloadHead fetches the current metadata of the file and downloads the
+// content of its head revision, returning the ID of that revision along
+// with it. Content derived from it can later be uploaded against that
+// revision, to tell whether the file changed on Drive in the meantime.
+func (f *file) DownloadHead(ctx context.Context) (io.ReadCloser, string, error) {
+	if err := f.refresh(ctx); err != nil {
+		return nil, "", err
+	}
+	rev := f.HeadRevisionID()
+	if rev == "" {
+		r, err := f.Download(ctx)
+		return r, "", err
+	}
+	res, err := f.GD.Revisions.Get(f.ID(), rev).Context(ctx).Download()
+	if err != nil {
+		return nil, "", err
+	}
+	return &verifyingReader{r: res.Body, v: NewVerifier(f)}, rev, nil
+}
+
+// NewChild adds a file that does not exist on Drive yet to the directory.
+// The file is created on Drive when its content is first uploaded.
+func (f *file) NewChild(name string) (File, error) {
+	if !f.IsDir() {
+		return nil, errors.New("not a directory")
+	}
+	mimeType := mime.TypeByExtension(filepath.Ext(name))
+	if i := strings.Index(mimeType, ";"); i >= 0 {
+		mimeType = mimeType[:i] // Drive wants no charset parameter.
+	}
+	c := &file{
+		GD:         f.GD,
+		name:       name,
+		parentID:   f.ID(),
+		parentName: f.name,
+		mimeType:   mimeType,
+	}
+	f.mu.Lock()
+	f.files = append(f.files, c)
+	f.mu.Unlock()
+	return c, nil
+}
+
+// Upload replaces the content of the file on Drive with the content of the
+// local file at localPath, creating the file on Drive if needed, and
+// returns the new head revision of the file. If the content on Drive is no
+// longer baseRevision, the revision the local content derives from, the
+// local content is saved to a conflict copy instead, the file picks up the
+// changes and the returned revision is empty.
+func (f *file) Upload(ctx context.Context, u *Uploader, localPath, baseRevision string) (string, error) {
+	f.mu.Lock()
+	t := UploadTarget{
+		FileID:       f.id,
+		Name:         f.name,
+		ParentID:     f.parentID,
+		MimeType:     f.mimeType,
+		BaseRevision: baseRevision,
+	}
+	f.mu.Unlock()
+	res, err := u.Upload(ctx, t, localPath)
+	if err != nil {
+		return "", err
+	}
+	if t.FileID != "" && res.Id != t.FileID {
+		return "", f.refresh(ctx)
+	}
+	f.update(res)
+	return res.HeadRevisionId, nil
+}
+
+// refresh fetches the current metadata of the file from Drive.
+func (f *file) refresh(ctx context.Context) error {
+	ctx, body := keepBody(ctx)
+	res, err := f.GD.Files.Get(f.ID()).Context(ctx).SupportsAllDrives(true).
+		Fields(fileFields).Do()
+	if err != nil {
+		return err
+	}
+	f.update(res)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sha256Checksum = body.sha256Checksums()[res.Id]
+	f.description = res.Description
+	f.properties = res.Properties
+	f.appProperties = res.AppProperties
+	return nil
+}
+
+func (f *file) update(res *drive.File) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.id = res.Id
+	f.size = uint64(res.Size)
+	f.md5Checksum = res.Md5Checksum
+	f.sha256Checksum = ""
+	f.version = res.Version
+	f.headRevisionID = res.HeadRevisionId
+	f.mimeType = res.MimeType
+}
+
+// DownloadRange downloads up to length bytes of the file content starting
+// at offset off, without caching them.
+func (f *file) DownloadRange(ctx context.Context, off, length int64) ([]byte, error) {
+	call := f.GD.Files.Get(f.ID()).Context(ctx).SupportsAllDrives(true)
+	call.Header().Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+	r, err := call.Download()
 	if err != nil {
 		return nil, err
 	}
-	f.content = make([]byte, f.size)
-	f.content = data
-	f.contentDownloaded = true
-	fmt.Printf("total downloaded bytes: %d, reported size: %d\n", len(data), f.size)
-	return f.contentReader(), nil
+	defer r.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(r.Body, length))
+	downloadedBytes.Add(float64(len(data)))
+	return data, err
+}
+
+func (f *file) Description() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.description
+}
+
+// Properties returns the custom properties of the file in the given scope,
+// one of PropertyScopePublic or PropertyScopePrivate.
+func (f *file) Properties(scope int) map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if scope == PropertyScopePrivate {
+		return f.appProperties
+	}
+	return f.properties
 }
 
-func (f *file) contentReader() io.ReadCloser {
-	return io.NopCloser(bufio.NewReader(bytes.NewReader(f.content)))
+func (f *file) SetDescription(ctx context.Context, desc string) error {
+	meta := &drive.File{Description: desc}
+	if desc == "" {
+		meta.ForceSendFields = []string{"Description"}
+	}
+	return f.updateMetadata(ctx, meta)
+}
+
+func (f *file) SetProperty(
+	ctx context.Context, scope int, key, value string) error {
+	props := map[string]string{key: value}
+	meta := &drive.File{}
+	if scope == PropertyScopePrivate {
+		meta.AppProperties = props
+	} else {
+		meta.Properties = props
+	}
+	return f.updateMetadata(ctx, meta)
+}
+
+func (f *file) RemoveProperty(ctx context.Context, scope int, key string) error {
+	if _, ok := f.Properties(scope)[key]; !ok {
+		return ErrNoProperty
+	}
+	// Drive deletes a property when it is set to null.
+	meta := &drive.File{}
+	if scope == PropertyScopePrivate {
+		meta.NullFields = []string{"AppProperties." + key}
+	} else {
+		meta.NullFields = []string{"Properties." + key}
+	}
+	return f.updateMetadata(ctx, meta)
+}
+
+// updateMetadata patches the metadata of the file on Drive and refreshes
+// the local copy with what Drive reports back.
+func (f *file) updateMetadata(ctx context.Context, meta *drive.File) error {
+	res, err := f.GD.Files.Update(f.ID(), meta).Context(ctx).SupportsAllDrives(true).
+		Fields("description, properties, appProperties").Do()
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.description = res.Description
+	f.properties = res.Properties
+	f.appProperties = res.AppProperties
+	return nil
 }
@@ -0,0 +1,158 @@
+package driveapi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+// TestFile_ConcurrentUpdate updates a file as an upload worker does while
+// reading it as FUSE does. It is meant to be run with -race.
+func TestFile_ConcurrentUpdate(t *testing.T) {
+	dir := &file{id: "did", mimeType: GoogleAppsMimeTypeText(MimeTypeGoogleDriveFolder), lsTime: time.Now()}
+	c, err := dir.NewChild("a.txt")
+	if err != nil {
+		t.Fatalf("NewChild() error = %v", err)
+	}
+	f := c.(*file)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			f.update(&drive.File{Id: "fid", Size: int64(i), Md5Checksum: "abc",
+				Version: int64(i), HeadRevisionId: fmt.Sprint(i), MimeType: "text/plain"})
+			if _, err := dir.NewChild(fmt.Sprintf("new-%d.txt", i)); err != nil {
+				t.Errorf("NewChild() error = %v", err)
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		_ = f.ID() + f.MD5Checksum() + f.HeadRevisionID() + f.MimeType() + f.String()
+		_, _ = f.Size(), f.Version()
+		if _, err := dir.ListFiles(context.TODO()); err != nil {
+			t.Fatalf("ListFiles() error = %v", err)
+		}
+		_ = dir.Files()
+	}
+	wg.Wait()
+	if got := len(dir.Files()); got != 101 {
+		t.Errorf("len(Files()) = %d, want 101", got)
+	}
+	if f.ID() != "fid" || f.Size() != 99 {
+		t.Errorf("file after updates = %v", f)
+	}
+}
+
+func TestFile_DownloadHead(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/files/fid":
+			fmt.Fprintf(w, `{"id": "fid", "name": "a.txt", "size": "3", "md5Checksum": "%s", "headRevisionId": "r7"}`, abcMD5)
+		case "/files/fid/revisions/r7":
+			fmt.Fprint(w, "abc")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	svc, err := NewService(context.TODO(), srv.Client(), option.WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Listed before the file changed on Drive.
+	f := &file{GD: svc, id: "fid", name: "a.txt", headRevisionID: "r6"}
+
+	rc, rev, err := f.DownloadHead(context.TODO())
+	if err != nil {
+		t.Fatalf("DownloadHead() error = %v", err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil || string(b) != "abc" || rev != "r7" {
+		t.Errorf("DownloadHead() = %q, %q, %v, want %q, r7", b, rev, err, "abc")
+	}
+}
+
+func TestFile_ListTTL(t *testing.T) {
+	var lists int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lists++
+		fmt.Fprint(w, `{"files": [{"id": "a", "name": "a.txt"}]}`)
+	}))
+	defer srv.Close()
+	svc, err := NewService(context.TODO(), srv.Client(), option.WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetListTTL(DefaultListTTL)
+	dir := &file{GD: svc, id: "did", mimeType: GoogleAppsMimeTypeText(MimeTypeGoogleDriveFolder)}
+
+	for _, tt := range []struct {
+		ttl       time.Duration
+		wantLists int
+	}{
+		{DefaultListTTL, 1},
+		{DefaultListTTL, 1}, // Cached.
+		{0, 2},              // Applies to the cached listing too.
+	} {
+		SetListTTL(tt.ttl)
+		if _, err := dir.ListFiles(context.TODO()); err != nil {
+			t.Fatalf("ListFiles() error = %v", err)
+		}
+		if lists != tt.wantLists {
+			t.Errorf("with a TTL of %v, listed %d times, want %d", tt.ttl, lists, tt.wantLists)
+		}
+	}
+}
+
+func TestFile_ListFilesKeepsNewChildren(t *testing.T) {
+	listing := `{"files": [{"id": "a", "name": "a.txt"}]}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, listing)
+	}))
+	defer srv.Close()
+	svc, err := NewService(context.TODO(), srv.Client(), option.WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetListTTL(DefaultListTTL)
+	SetListTTL(0)
+	dir := &file{GD: svc, id: "did", mimeType: GoogleAppsMimeTypeText(MimeTypeGoogleDriveFolder)}
+	if _, err := dir.ListFiles(context.TODO()); err != nil {
+		t.Fatalf("ListFiles() error = %v", err)
+	}
+	if _, err := dir.NewChild("b.txt"); err != nil {
+		t.Fatalf("NewChild() error = %v", err)
+	}
+
+	names := func() []string {
+		files, err := dir.ListFiles(context.TODO())
+		if err != nil {
+			t.Fatalf("ListFiles() error = %v", err)
+		}
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		return names
+	}
+	// Not uploaded yet.
+	if got := fmt.Sprint(names()); got != "[a.txt b.txt]" {
+		t.Errorf("ListFiles() = %s, want [a.txt b.txt]", got)
+	}
+	// Uploaded; listed once.
+	listing = `{"files": [{"id": "a", "name": "a.txt"}, {"id": "b", "name": "b.txt"}]}`
+	if got := fmt.Sprint(names()); got != "[a.txt b.txt]" {
+		t.Errorf("ListFiles() = %s, want [a.txt b.txt]", got)
+	}
+}
@@ -0,0 +1,15 @@
+package driveapi
+
+import "github.com/althk/drivefs/metrics"
+
+var (
+	apiCalls = metrics.NewCounter("drivefs_drive_api_calls_total",
+		"Requests sent to the Drive API, by API method and response status.",
+		"method", "status")
+	requestRetries = metrics.NewCounter("drivefs_drive_retries_total",
+		"Drive requests retried after a failure, by operation.", "op")
+	downloadedBytes = metrics.NewCounter("drivefs_drive_downloaded_bytes_total",
+		"File content bytes downloaded from Drive.")
+	uploadedBytes = metrics.NewCounter("drivefs_drive_uploaded_bytes_total",
+		"File content bytes uploaded to Drive.")
+)
@@ -0,0 +1,110 @@
+package driveapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// ErrNotFound is returned when a path names no file.
+var ErrNotFound = errors.New("no such file or directory")
+
+// Lookup returns the file at path, relative to dir. Path elements are
+// separated by slashes; empty and "." elements are skipped.
+func Lookup(ctx context.Context, dir File, path string) (File, error) {
+	file := dir
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		files, err := file.ListFiles(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var next File
+		for _, c := range files {
+			if c.Name() == name {
+				next = c
+				break
+			}
+		}
+		if next == nil {
+			return nil, ErrNotFound
+		}
+		file = next
+	}
+	return file, nil
+}
+
+// ErrNotFolder is returned when a folder is expected but another kind of
+// file is found.
+var ErrNotFolder = errors.New("not a folder")
+
+// Folder returns the folder named by spec, to be used as the root of a
+// tree: a path from My Drive starting with a slash, the name of a shared
+// drive, or the ID of a folder in any drive. An empty spec is My Drive.
+func Folder(ctx context.Context, drv *drive.Service, spec string) (File, error) {
+	if spec == "" {
+		return RootFolder(ctx, drv)
+	}
+	if strings.HasPrefix(spec, "/") {
+		root, err := RootFolder(ctx, drv)
+		if err != nil {
+			return nil, err
+		}
+		f, err := Lookup(ctx, root, spec)
+		if err == nil && !f.IsDir() {
+			err = ErrNotFolder
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", spec, err)
+		}
+		return f, nil
+	}
+
+	drives, err := drv.Drives.List().Context(ctx).
+		Q(fmt.Sprintf("name = '%s'", quoteQuery(spec))).
+		Fields("drives(id, name)").Do()
+	if err != nil {
+		return nil, fmt.Errorf("error listing shared drives: %w", err)
+	}
+	switch len(drives.Drives) {
+	case 0:
+	case 1:
+		d := drives.Drives[0]
+		return newRoot(drv, &drive.File{Id: d.Id, Name: d.Name}), nil
+	default:
+		return nil, fmt.Errorf("%d shared drives are named %q, give the ID of one", len(drives.Drives), spec)
+	}
+
+	res, err := drv.Files.Get(spec).Context(ctx).SupportsAllDrives(true).Fields(rootFields).Do()
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code == http.StatusNotFound {
+		return nil, fmt.Errorf("%v is neither a shared drive nor a folder ID: %w", spec, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching folder %v: %w", spec, err)
+	}
+	if res.MimeType != GoogleAppsMimeTypeText(MimeTypeGoogleDriveFolder) {
+		return nil, fmt.Errorf("%v: %w", spec, ErrNotFolder)
+	}
+	return newRoot(drv, res), nil
+}
+
+// quoteQuery escapes s to appear in quotes in a Drive search query.
+func quoteQuery(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+}
+
+// Trash moves the file to the Drive trash, from where it can be restored
+// for 30 days.
+func Trash(ctx context.Context, drv *drive.Service, f File) error {
+	_, err := drv.Files.Update(f.ID(), &drive.File{Trashed: true}).
+		Context(ctx).SupportsAllDrives(true).Fields("id").Do()
+	return err
+}
@@ -0,0 +1,139 @@
+package driveapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+func TestLookupAndTrash(t *testing.T) {
+	var trashed string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/files" && r.Method == http.MethodGet:
+			q := r.URL.Query().Get("q")
+			if !strings.Contains(q, "trashed = false") {
+				t.Errorf("listing query %q includes trashed files", q)
+			}
+			switch {
+			case strings.HasPrefix(q, "'root' "):
+				fmt.Fprint(w, `{"files": [{"id": "did1", "name": "Projects",
+					"mimeType": "application/vnd.google-apps.folder"}]}`)
+			case strings.HasPrefix(q, "'did1' "):
+				fmt.Fprint(w, `{"files": [{"id": "fid1", "name": "notes.txt", "mimeType": "text/plain"}]}`)
+			default:
+				fmt.Fprint(w, `{"files": []}`)
+			}
+		case r.URL.Path == "/files/fid1" && r.Method == http.MethodPatch:
+			b, _ := io.ReadAll(r.Body)
+			trashed = string(b)
+			fmt.Fprint(w, `{"id": "fid1"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	svc, err := drive.NewService(context.TODO(),
+		option.WithHTTPClient(srv.Client()), option.WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := &file{GD: svc, id: "root", mimeType: GoogleAppsMimeTypeText(MimeTypeGoogleDriveFolder)}
+
+	f, err := Lookup(context.TODO(), root, "/Projects//notes.txt")
+	if err != nil {
+		t.Fatalf("Lookup() error = %v", err)
+	}
+	if f.ID() != "fid1" {
+		t.Errorf("Lookup() = %v, want fid1", f)
+	}
+	if f, err := Lookup(context.TODO(), root, "."); err != nil || f != root {
+		t.Errorf("Lookup(.) = %v, %v, want the root", f, err)
+	}
+	if _, err := Lookup(context.TODO(), root, "Projects/missing"); err != ErrNotFound {
+		t.Errorf("Lookup() of a missing file error = %v, want ErrNotFound", err)
+	}
+
+	if err := Trash(context.TODO(), svc, f); err != nil {
+		t.Fatalf("Trash() error = %v", err)
+	}
+	if !strings.Contains(trashed, `"trashed":true`) {
+		t.Errorf("Trash() sent %s, want trashed set", trashed)
+	}
+}
+
+func TestFolder(t *testing.T) {
+	const folderType = "application/vnd.google-apps.folder"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/drives":
+			if q := r.URL.Query().Get("q"); q == "name = 'Team\\'s data'" {
+				fmt.Fprint(w, `{"drives": [{"id": "0AteamDrive", "name": "Team's data"}]}`)
+				return
+			}
+			fmt.Fprint(w, `{"drives": []}`)
+		case "/files/root":
+			fmt.Fprint(w, `{"id": "rootid", "name": "My Drive", "mimeType": "`+folderType+`"}`)
+		case "/files/did1":
+			if r.URL.Query().Get("supportsAllDrives") != "true" {
+				t.Errorf("folder fetched without supportsAllDrives: %v", r.URL)
+			}
+			fmt.Fprint(w, `{"id": "did1", "name": "ml-data", "mimeType": "`+folderType+`"}`)
+		case "/files/fid1":
+			fmt.Fprint(w, `{"id": "fid1", "name": "notes.txt", "mimeType": "text/plain"}`)
+		case "/files":
+			if strings.HasPrefix(r.URL.Query().Get("q"), "'rootid' ") {
+				fmt.Fprint(w, `{"files": [{"id": "did1", "name": "Projects", "mimeType": "`+folderType+`"},
+					{"id": "fid1", "name": "notes.txt", "mimeType": "text/plain"}]}`)
+				return
+			}
+			fmt.Fprint(w, `{"files": []}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": {"code": 404, "message": "File not found"}}`)
+		}
+	}))
+	defer srv.Close()
+	svc, err := drive.NewService(context.TODO(),
+		option.WithHTTPClient(srv.Client()), option.WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		spec, wantID string
+		wantErr      error
+	}{
+		{spec: "", wantID: "rootid"},
+		{spec: "/Projects", wantID: "did1"},
+		{spec: "Team's data", wantID: "0AteamDrive"},
+		{spec: "did1", wantID: "did1"},
+		{spec: "/notes.txt", wantErr: ErrNotFolder},
+		{spec: "fid1", wantErr: ErrNotFolder},
+		{spec: "/missing", wantErr: ErrNotFound},
+		{spec: "nosuchid", wantErr: ErrNotFound},
+	} {
+		f, err := Folder(context.TODO(), svc, tt.spec)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Folder(%q) error = %v, want %v", tt.spec, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Folder(%q) error = %v", tt.spec, err)
+			continue
+		}
+		if f.ID() != tt.wantID || !f.IsDir() {
+			t.Errorf("Folder(%q) = %v (id %s), want folder %s", tt.spec, f, f.ID(), tt.wantID)
+		}
+	}
+}
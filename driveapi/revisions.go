@@ -0,0 +1,160 @@
+package driveapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// ErrRevisionReadOnly is returned when trying to change a past revision of
+// a file.
+var ErrRevisionReadOnly = errors.New("revisions are read-only")
+
+// RevisionTimeFormat is the format of the timestamp revisions are named by.
+const RevisionTimeFormat = "2006-01-02T15:04:05Z"
+
+// Revisions lists the past revisions of the file kept by Drive, oldest
+// first. Each one is a read-only file named by the time it was made, with
+// the extension of the file. Google Apps files have no downloadable
+// revisions, so there are none for them.
+func (f *file) Revisions(ctx context.Context) ([]File, error) {
+	if f.IsDir() || f.IsGoogleAppsFile() || f.ID() == "" {
+		return nil, nil
+	}
+	var revs []File
+	var nextPageToken string
+	for {
+		res, err := f.GD.Revisions.List(f.ID()).Context(ctx).
+			Fields("nextPageToken, revisions(id, modifiedTime, size, md5Checksum)").
+			PageToken(nextPageToken).
+			Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range res.Revisions {
+			revs = append(revs, newRevision(f, r))
+		}
+		if res.NextPageToken == "" {
+			return revs, nil
+		}
+		nextPageToken = res.NextPageToken
+	}
+}
+
+func newRevision(f *file, r *drive.Revision) *revision {
+	name := r.Id
+	if t, err := time.Parse(time.RFC3339, r.ModifiedTime); err == nil {
+		name = t.UTC().Format(RevisionTimeFormat)
+	}
+	return &revision{
+		file:        f,
+		id:          r.Id,
+		name:        name + filepath.Ext(f.name),
+		size:        uint64(r.Size),
+		md5Checksum: r.Md5Checksum,
+	}
+}
+
+// revision is a past revision of a file. Its content can be downloaded,
+// but nothing about it can be changed.
+type revision struct {
+	file        *file
+	id, name    string
+	size        uint64
+	md5Checksum string
+}
+
+func (r *revision) String() string {
+	return fmt.Sprintf("%s (revision %s of %s)", r.name, r.id, r.file.name)
+}
+
+func (r *revision) IsDir() bool            { return false }
+func (r *revision) IsGoogleAppsFile() bool { return false }
+func (r *revision) Size() uint64           { return r.size }
+func (r *revision) Name() string           { return r.name }
+func (r *revision) MimeType() string       { return r.file.mimeType }
+func (r *revision) ParentID() string       { return r.file.parentID }
+func (r *revision) ParentName() string     { return r.file.parentName }
+func (r *revision) MD5Checksum() string    { return r.md5Checksum }
+func (r *revision) SHA256Checksum() string { return "" }
+func (r *revision) Version() int64         { return 0 }
+func (r *revision) Files() []File          { return nil }
+func (r *revision) Description() string    { return "" }
+
+// ID returns the ID of the file the revision belongs to and the ID of the
+// revision, as fileID@revisionID, so that the revision is not taken for the
+// file, e.g. by the block cache.
+func (r *revision) ID() string {
+	return r.file.ID() + "@" + r.id
+}
+
+// HeadRevisionID returns the ID of the revision itself.
+func (r *revision) HeadRevisionID() string {
+	return r.id
+}
+
+func (r *revision) Properties(int) map[string]string {
+	return nil
+}
+
+func (r *revision) ListFiles(context.Context) ([]File, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (r *revision) Revisions(context.Context) ([]File, error) {
+	return nil, nil
+}
+
+func (r *revision) Invalidate() {}
+
+func (r *revision) Download(ctx context.Context) (io.ReadCloser, error) {
+	res, err := r.file.GD.Revisions.Get(r.file.ID(), r.id).Context(ctx).Download()
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReader{r: res.Body, v: NewVerifier(r)}, nil
+}
+
+// DownloadHead downloads the content of the revision, which never changes.
+func (r *revision) DownloadHead(ctx context.Context) (io.ReadCloser, string, error) {
+	rc, err := r.Download(ctx)
+	return rc, r.id, err
+}
+
+func (r *revision) DownloadRange(ctx context.Context, off, length int64) ([]byte, error) {
+	call := r.file.GD.Revisions.Get(r.file.ID(), r.id).Context(ctx)
+	call.Header().Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+	res, err := call.Download()
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(res.Body, length))
+	downloadedBytes.Add(float64(len(data)))
+	return data, err
+}
+
+func (r *revision) NewChild(string) (File, error) {
+	return nil, ErrRevisionReadOnly
+}
+
+func (r *revision) Upload(context.Context, *Uploader, string, string) (string, error) {
+	return "", ErrRevisionReadOnly
+}
+
+func (r *revision) SetDescription(context.Context, string) error {
+	return ErrRevisionReadOnly
+}
+
+func (r *revision) SetProperty(context.Context, int, string, string) error {
+	return ErrRevisionReadOnly
+}
+
+func (r *revision) RemoveProperty(context.Context, int, string) error {
+	return ErrRevisionReadOnly
+}
@@ -0,0 +1,73 @@
+package driveapi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+func TestFile_Revisions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/files/fid1/revisions":
+			if r.URL.Query().Get("pageToken") == "" {
+				fmt.Fprint(w, `{"nextPageToken": "p2", "revisions": [
+					{"id": "r1", "modifiedTime": "2021-03-04T05:06:07.123Z", "size": "3",
+					 "md5Checksum": "900150983cd24fb0d6963f7d28e17f72"}]}`)
+				return
+			}
+			fmt.Fprint(w, `{"revisions": [{"id": "r2", "modifiedTime": "2021-03-05T00:00:00Z", "size": "7"}]}`)
+		case "/files/fid1/revisions/r1":
+			if r.URL.Query().Get("alt") != "media" {
+				t.Errorf("revision downloaded without alt=media: %v", r.URL)
+			}
+			fmt.Fprint(w, "abc")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	svc, err := drive.NewService(context.TODO(),
+		option.WithHTTPClient(srv.Client()), option.WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &file{GD: svc, id: "fid1", name: "notes.txt", mimeType: "text/plain"}
+
+	revs, err := f.Revisions(context.TODO())
+	if err != nil {
+		t.Fatalf("Revisions() error = %v", err)
+	}
+	var names []string
+	for _, r := range revs {
+		names = append(names, r.Name())
+	}
+	want := []string{"2021-03-04T05:06:07Z.txt", "2021-03-05T00:00:00Z.txt"}
+	if fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Fatalf("Revisions() names = %q, want %q", names, want)
+	}
+	if revs[0].Size() != 3 || revs[0].ID() != "fid1@r1" || revs[0].HeadRevisionID() != "r1" {
+		t.Errorf("Revisions()[0] = %v (size %d, id %s)", revs[0], revs[0].Size(), revs[0].ID())
+	}
+
+	rc, err := revs[0].Download(context.TODO())
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	defer rc.Close()
+	if b, err := io.ReadAll(rc); err != nil || string(b) != "abc" {
+		t.Errorf("Download() of revision = %q, %v, want %q", b, err, "abc")
+	}
+	if _, err := revs[0].Upload(context.TODO(), nil, "", ""); err != ErrRevisionReadOnly {
+		t.Errorf("Upload() to revision error = %v, want ErrRevisionReadOnly", err)
+	}
+	if _, err := revs[0].NewChild("a.txt"); err != ErrRevisionReadOnly {
+		t.Errorf("NewChild() of revision error = %v, want ErrRevisionReadOnly", err)
+	}
+}
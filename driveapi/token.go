@@ -0,0 +1,130 @@
+package driveapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+)
+
+// ErrAuthRevoked is returned by every call once the OAuth refresh token has
+// been revoked or has expired, until the user authorizes drivefs again.
+var ErrAuthRevoked = errors.New("authorization revoked, authorize drivefs again")
+
+// reloadInterval is how often a revoked token is looked up in the store
+// again.
+const reloadInterval = 10 * time.Second
+
+// tokenSource is an oauth2.TokenSource that saves refreshed tokens to the
+// store. Once the refresh token is revoked, it looks up the store again
+// from time to time, so that a token saved by another process, such as
+// drivefs auth, is picked up without remounting.
+type tokenSource struct {
+	config *oauth2.Config
+	store  TokenStore
+
+	mu       sync.Mutex
+	src      oauth2.TokenSource
+	saved    *oauth2.Token // last token loaded from or saved to the store
+	revoked  error         // set once the refresh token was refused
+	reloaded time.Time     // when the store was last looked up since
+}
+
+func newTokenSource(config *oauth2.Config, store TokenStore, tok *oauth2.Token) *tokenSource {
+	s := &tokenSource{config: config, store: store}
+	s.use(tok)
+	return s
+}
+
+func (s *tokenSource) use(tok *oauth2.Token) {
+	s.saved = tok
+	s.src = s.config.TokenSource(context.Background(), tok)
+	s.revoked = nil
+}
+
+func (s *tokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.revoked != nil && !s.reload() {
+		return nil, s.revoked
+	}
+	tok, err := s.src.Token()
+	if err != nil {
+		if isInvalidGrant(err) {
+			logger.Error("the OAuth refresh token was revoked or has expired; "+
+				"run drivefs auth with the same token options to authorize again",
+				"store", s.store, "err", err)
+			s.revoked = fmt.Errorf("%w: %v", ErrAuthRevoked, err)
+			s.reloaded = time.Now()
+			return nil, s.revoked
+		}
+		return nil, err
+	}
+	if tok.AccessToken != s.saved.AccessToken {
+		if err := s.store.Save(tok); err != nil {
+			// The refresh token still works, so the next run can refresh
+			// again; there is no need to fail the call.
+			logger.Warn("unable to save refreshed token", "store", s.store, "err", err)
+		}
+		s.saved = tok
+	}
+	return tok, nil
+}
+
+// reload switches to the token in the store if it differs from the revoked
+// one, looking it up at most every reloadInterval. It reports whether it
+// switched.
+func (s *tokenSource) reload() bool {
+	if time.Since(s.reloaded) < reloadInterval {
+		return false
+	}
+	s.reloaded = time.Now()
+	tok, err := s.store.Load()
+	if err != nil {
+		logger.Warn("unable to reload token", "store", s.store, "err", err)
+		return false
+	}
+	if tok.RefreshToken == s.saved.RefreshToken && tok.AccessToken == s.saved.AccessToken {
+		return false
+	}
+	logger.Info("reloaded token", "store", s.store)
+	s.use(tok)
+	return true
+}
+
+// isInvalidGrant reports whether err is the token endpoint refusing the
+// refresh token.
+func isInvalidGrant(err error) bool {
+	var rerr *oauth2.RetrieveError
+	if !errors.As(err, &rerr) {
+		return false
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	return json.Unmarshal(rerr.Body, &body) == nil && body.Error == "invalid_grant"
+}
+
+// Authorize asks the user to authorize drivefs with the OAuth client ID in
+// b through opts.Flow, and saves the token to the store of opts, replacing
+// any token there. A running mount whose token was revoked picks it up.
+func Authorize(ctx context.Context, b []byte, opts AuthOptions) error {
+	if IsServiceAccount(b) {
+		return errors.New("service accounts need no authorization")
+	}
+	config, err := google.ConfigFromJSON(b, drive.DriveScope)
+	if err != nil {
+		return fmt.Errorf("unable to parse config from json: %w", err)
+	}
+	tok, err := authorize(ctx, config, opts.Flow)
+	if err != nil {
+		return err
+	}
+	return opts.store().Save(tok)
+}
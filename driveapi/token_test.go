@@ -0,0 +1,92 @@
+package driveapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestTokenSource_SavesRefreshedToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token": "new", "token_type": "Bearer", "expires_in": 3600}`)
+	}))
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "token.json")
+	store := NewFileTokenStore(path)
+	old := &oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)}
+	if err := store.Save(old); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTokenSource(&oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: srv.URL, AuthStyle: oauth2.AuthStyleInParams}}, store, old)
+	tok, err := s.Token()
+	if err != nil {
+		t.Fatalf("Token() error = %v", err)
+	}
+	if tok.AccessToken != "new" {
+		t.Errorf("Token() = %q, want the refreshed token", tok.AccessToken)
+	}
+	saved, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.AccessToken != "new" || saved.RefreshToken != "refresh" {
+		t.Errorf("saved token = %+v, want the refreshed token with the refresh token kept", saved)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("token file mode = %v (err %v), want 0600", fi.Mode(), err)
+	}
+}
+
+func TestTokenSource_Revoked(t *testing.T) {
+	refreshes := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		refreshes++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": "invalid_grant", "error_description": "Token has been expired or revoked."}`)
+	}))
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "token.json")
+	store := NewFileTokenStore(path)
+	old := &oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)}
+	if err := store.Save(old); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTokenSource(&oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: srv.URL, AuthStyle: oauth2.AuthStyleInParams}}, store, old)
+	for i := 0; i < 2; i++ {
+		if _, err := s.Token(); !errors.Is(err, ErrAuthRevoked) {
+			t.Fatalf("Token() error = %v, want ErrAuthRevoked", err)
+		}
+	}
+	if refreshes != 1 {
+		t.Errorf("refreshed %d times, want 1 until authorized again", refreshes)
+	}
+
+	// Authorizing again saves a new token, which is picked up once the
+	// store is looked up again.
+	fresh := &oauth2.Token{AccessToken: "fresh", RefreshToken: "refresh2", Expiry: time.Now().Add(time.Hour)}
+	if err := store.Save(fresh); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Token(); !errors.Is(err, ErrAuthRevoked) {
+		t.Fatalf("Token() before reloadInterval error = %v, want ErrAuthRevoked", err)
+	}
+	s.reloaded = time.Now().Add(-reloadInterval)
+	tok, err := s.Token()
+	if err != nil {
+		t.Fatalf("Token() after authorizing again error = %v", err)
+	}
+	if tok.AccessToken != "fresh" {
+		t.Errorf("Token() = %q, want the newly saved token", tok.AccessToken)
+	}
+}
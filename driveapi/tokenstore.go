@@ -0,0 +1,253 @@
+package driveapi
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// ErrNoToken is returned by TokenStore.Load when no token was saved yet.
+var ErrNoToken = errors.New("no saved token")
+
+// TokenStore keeps the OAuth token of the user between runs.
+type TokenStore interface {
+	// Load returns the saved token, or ErrNoToken if there is none.
+	Load() (*oauth2.Token, error)
+	// Save replaces the saved token.
+	Save(tok *oauth2.Token) error
+	// String describes where the token is kept, for log messages.
+	String() string
+}
+
+// NewFileTokenStore returns a store keeping the token as plain JSON in the
+// file at path.
+func NewFileTokenStore(path string) TokenStore {
+	return &fileTokenStore{path: path}
+}
+
+type fileTokenStore struct {
+	path string
+}
+
+func (s *fileTokenStore) String() string { return s.path }
+
+func (s *fileTokenStore) Load() (*oauth2.Token, error) {
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal(b, tok); err != nil {
+		return nil, fmt.Errorf("unable to parse token in %v: %w", s.path, err)
+	}
+	if tok.AccessToken == "" && tok.RefreshToken == "" {
+		return nil, fmt.Errorf("%v holds no OAuth token", s.path)
+	}
+	return tok, nil
+}
+
+func (s *fileTokenStore) Save(tok *oauth2.Token) error {
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, b, 0600); err != nil {
+		return fmt.Errorf("unable to save token to %v: %w", s.path, err)
+	}
+	return nil
+}
+
+// ErrWrongPassphrase is returned when an encrypted token cannot be
+// decrypted with the passphrase given.
+var ErrWrongPassphrase = errors.New("wrong token passphrase")
+
+// pbkdf2Iterations is the work factor of the key derived from the
+// passphrase of an encrypted token file.
+const pbkdf2Iterations = 200000
+
+// encryptedToken is the content of an encrypted token file. The token JSON
+// is sealed with AES-256-GCM under a key derived from the passphrase with
+// PBKDF2-HMAC-SHA256.
+type encryptedToken struct {
+	Version    int    `json:"version"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Data       []byte `json:"data"`
+}
+
+// NewEncryptedTokenStore returns a store keeping the token in the file at
+// path, encrypted with a key derived from passphrase.
+func NewEncryptedTokenStore(path string, passphrase []byte) TokenStore {
+	return &encryptedTokenStore{path: path, passphrase: passphrase}
+}
+
+type encryptedTokenStore struct {
+	path       string
+	passphrase []byte
+}
+
+func (s *encryptedTokenStore) String() string { return s.path + " (encrypted)" }
+
+func (s *encryptedTokenStore) Load() (*oauth2.Token, error) {
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	var et encryptedToken
+	if err := json.Unmarshal(b, &et); err != nil || et.Version != 1 {
+		return nil, fmt.Errorf("%v is not an encrypted token file", s.path)
+	}
+	aead, err := s.aead(et.Salt, et.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, et.Nonce, et.Data, nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal(plain, tok); err != nil {
+		return nil, fmt.Errorf("unable to parse token in %v: %w", s.path, err)
+	}
+	return tok, nil
+}
+
+func (s *encryptedTokenStore) Save(tok *oauth2.Token) error {
+	plain, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	et := encryptedToken{Version: 1, Iterations: pbkdf2Iterations, Salt: make([]byte, 16)}
+	if _, err := rand.Read(et.Salt); err != nil {
+		return err
+	}
+	aead, err := s.aead(et.Salt, et.Iterations)
+	if err != nil {
+		return err
+	}
+	et.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(et.Nonce); err != nil {
+		return err
+	}
+	et.Data = aead.Seal(nil, et.Nonce, plain, nil)
+	b, err := json.Marshal(et)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, b, 0600); err != nil {
+		return fmt.Errorf("unable to save token to %v: %w", s.path, err)
+	}
+	return nil
+}
+
+func (s *encryptedTokenStore) aead(salt []byte, iterations int) (cipher.AEAD, error) {
+	if len(s.passphrase) == 0 {
+		return nil, errors.New("no token passphrase given")
+	}
+	block, err := aes.NewCipher(pbkdf2(s.passphrase, salt, iterations, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// pbkdf2 derives a key of keyLen bytes from password as in RFC 8018, with
+// HMAC-SHA256 as the pseudorandom function.
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// secretTool is the libsecret command line tool the keyring store uses to
+// talk to the Secret Service over D-Bus.
+var secretTool = "secret-tool"
+
+// NewKeyringTokenStore returns a store keeping the token in the keyring of
+// the desktop session, such as GNOME Keyring or KWallet, through the
+// Secret Service D-Bus API. Tokens are told apart by name.
+func NewKeyringTokenStore(name string) TokenStore {
+	return &keyringTokenStore{name: name}
+}
+
+type keyringTokenStore struct {
+	name string
+}
+
+func (s *keyringTokenStore) String() string { return "keyring token " + s.name }
+
+func (s *keyringTokenStore) attributes() []string {
+	return []string{"service", "drivefs", "token", s.name}
+}
+
+func (s *keyringTokenStore) Load() (*oauth2.Token, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(secretTool, append([]string{"lookup"}, s.attributes()...)...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		// secret-tool exits with 1 and says nothing when there is no match.
+		if errors.As(err, &exitErr) && stderr.Len() == 0 {
+			return nil, ErrNoToken
+		}
+		return nil, fmt.Errorf("unable to read token from keyring: %v: %s", err,
+			strings.TrimSpace(stderr.String()))
+	}
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal(stdout.Bytes(), tok); err != nil {
+		return nil, fmt.Errorf("unable to parse token from keyring: %w", err)
+	}
+	return tok, nil
+}
+
+func (s *keyringTokenStore) Save(tok *oauth2.Token) error {
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"store", "--label", "drivefs OAuth token " + s.name}, s.attributes()...)
+	var stderr bytes.Buffer
+	cmd := exec.Command(secretTool, args...)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("unable to save token to keyring: %v: %s", err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package driveapi
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// Test vector from RFC 7914, section 11.
+	got := pbkdf2([]byte("passwd"), []byte("salt"), 1, 64)
+	want, _ := hex.DecodeString("55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783")
+	if !bytes.Equal(got, want) {
+		t.Errorf("pbkdf2() = %x, want %x", got, want)
+	}
+}
+
+func TestEncryptedTokenStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.enc")
+	store := NewEncryptedTokenStore(path, []byte("correct horse"))
+	if _, err := store.Load(); err != ErrNoToken {
+		t.Fatalf("Load() before Save error = %v, want ErrNoToken", err)
+	}
+	tok := &oauth2.Token{AccessToken: "access", RefreshToken: "secret-refresh", TokenType: "Bearer"}
+	if err := store.Save(tok); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("secret-refresh")) {
+		t.Error("the token file holds the refresh token in the clear")
+	}
+	got, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if got.AccessToken != "access" || got.RefreshToken != "secret-refresh" {
+		t.Errorf("Load() = %+v, want the saved token", got)
+	}
+	if _, err := NewEncryptedTokenStore(path, []byte("wrong")).Load(); err != ErrWrongPassphrase {
+		t.Errorf("Load() with the wrong passphrase error = %v, want ErrWrongPassphrase", err)
+	}
+	if _, err := NewFileTokenStore(path).Load(); err == nil {
+		t.Error("plain Load() of an encrypted token succeeded")
+	}
+}
+
+func TestKeyringTokenStore(t *testing.T) {
+	// A fake secret-tool keeping secrets in files named by their
+	// attributes.
+	dir := t.TempDir()
+	script := filepath.Join(dir, "secret-tool")
+	err := os.WriteFile(script, []byte(`#!/bin/sh
+cmd=$1; shift
+[ "$1" = --label ] && shift 2
+key="`+dir+`/$(echo "$@" | tr ' ' _)"
+case $cmd in
+store) cat > "$key" ;;
+lookup) [ -f "$key" ] || exit 1; cat "$key" ;;
+esac
+`), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old string) { secretTool = old }(secretTool)
+	secretTool = script
+
+	store := NewKeyringTokenStore("work")
+	if _, err := store.Load(); !errors.Is(err, ErrNoToken) {
+		t.Fatalf("Load() before Save error = %v, want ErrNoToken", err)
+	}
+	if err := store.Save(&oauth2.Token{AccessToken: "access", RefreshToken: "refresh"}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	got, err := store.Load()
+	if err != nil || got.RefreshToken != "refresh" {
+		t.Errorf("Load() = %+v, %v, want the saved token", got, err)
+	}
+	if _, err := NewKeyringTokenStore("home").Load(); !errors.Is(err, ErrNoToken) {
+		t.Errorf("Load() of another name error = %v, want ErrNoToken", err)
+	}
+}
@@ -0,0 +1,445 @@
+package driveapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	uploadURL = "https://www.googleapis.com/upload/drive/v3/files"
+	// ChunkAlign is the granularity Drive requires for the size of all but
+	// the last chunk of a resumable upload.
+	ChunkAlign = 256 << 10
+	// DefaultChunkSize is used when Uploader.ChunkSize is not set.
+	DefaultChunkSize = 32 * ChunkAlign
+	// sessionLifetime is how long Drive keeps resumable sessions around,
+	// minus a safety margin.
+	sessionLifetime = 6 * 24 * time.Hour
+	uploadFields    = "id, name, size, parents, mimeType, md5Checksum, version, headRevisionId"
+)
+
+// errSessionExpired is returned when Drive no longer knows about an
+// upload session.
+var errSessionExpired = errors.New("upload session expired")
+
+// UploadTarget describes the Drive file that content is uploaded to.
+type UploadTarget struct {
+	// FileID of the file to replace the content of, empty to create a new
+	// file named Name in the folder ParentID.
+	FileID   string
+	Name     string
+	ParentID string
+	MimeType string
+	// BaseRevision is the head revision of the file that the content was
+	// derived from. If set and the file has another head revision by the
+	// time the upload starts, the content is uploaded to a conflict copy
+	// next to the file instead of overwriting the changes made on Drive.
+	BaseRevision string
+}
+
+// Uploader uploads files to Drive using the resumable upload protocol. The
+// content is sent in chunks of ChunkSize bytes, and the session of every
+// upload in progress is recorded in Journal, so that an upload interrupted
+// by a network error or a restart resumes from the last chunk Drive got.
+// See https://developers.google.com/drive/api/v3/manage-uploads#resumable
+type Uploader struct {
+	Client *http.Client
+	// Service is used to detect conflicting changes, which are not checked
+	// for if it is nil.
+	Service *drive.Service
+	// URL of the upload endpoint, the Drive one if empty.
+	URL string
+	// ChunkSize must be a multiple of ChunkAlign.
+	ChunkSize int64
+	Journal   *Journal
+	// MaxRetries is the number of times a chunk is retried after a network
+	// or server error before giving up.
+	MaxRetries int
+}
+
+// Upload uploads the content of the local file at path to the target and
+// returns the resulting Drive file, which is a new file if the content went
+// to a conflict copy.
+func (u *Uploader) Upload(ctx context.Context, t UploadTarget, path string) (*drive.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := u.Journal.load(path)
+	if err != nil {
+		return nil, err
+	}
+	if e != nil && (e.Original != t || e.Size != st.Size() ||
+		!e.ModTime.Equal(st.ModTime()) || time.Since(e.Started) > sessionLifetime) {
+		e = nil
+	}
+	if e != nil {
+		res, offset, err := u.status(ctx, e)
+		switch {
+		case err == errSessionExpired:
+			e = nil
+		case err != nil:
+			return nil, err
+		case res != nil:
+			return res, u.Journal.remove(path)
+		default:
+			logger.Info("resuming upload", "path", path, "offset", offset, "size", e.Size)
+			e.Offset = offset
+		}
+	}
+	if e == nil {
+		e = &journalEntry{
+			Path:     path,
+			Target:   t,
+			Original: t,
+			Size:     st.Size(),
+			ModTime:  st.ModTime(),
+			Started:  time.Now(),
+		}
+		conflict, err := u.conflict(ctx, t)
+		if err != nil {
+			return nil, err
+		}
+		if conflict {
+			e.Target = UploadTarget{
+				Name:     ConflictName(t.Name, time.Now()),
+				ParentID: t.ParentID,
+				MimeType: t.MimeType,
+			}
+			logger.Warn("file changed on Drive since it was opened, saving local copy as a conflict copy",
+				"file", t.FileID, "name", t.Name, "copy", e.Target.Name)
+		}
+		if e.SessionURI, err = u.startSession(ctx, e.Target, e.Size); err != nil {
+			return nil, err
+		}
+		if err := u.Journal.save(e); err != nil {
+			return nil, err
+		}
+	}
+
+	for retries := 0; ; {
+		res, offset, err := u.sendChunk(ctx, e, f)
+		if err != nil {
+			if !retryable(err) || retries >= u.MaxRetries {
+				return nil, err
+			}
+			retries++
+			requestRetries.Inc("upload")
+			logger.Warn("upload chunk failed, retrying", "path", path, "offset", e.Offset,
+				"size", e.Size, "retry", retries, "max_retries", u.MaxRetries, "err", err)
+			if err := sleep(ctx, backoff(retries)); err != nil {
+				return nil, err
+			}
+			// The chunk may have been partially received.
+			if res, offset, err = u.status(ctx, e); err != nil {
+				if retryable(err) {
+					continue
+				}
+				return nil, err
+			}
+		}
+		if res != nil {
+			return res, u.Journal.remove(path)
+		}
+		if offset > e.Offset {
+			retries = 0
+		}
+		e.Offset = offset
+		if err := u.Journal.save(e); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// conflict reports whether the file that t updates has changed on Drive
+// since the content was derived from it.
+func (u *Uploader) conflict(ctx context.Context, t UploadTarget) (bool, error) {
+	if u.Service == nil || t.FileID == "" || t.BaseRevision == "" {
+		return false, nil
+	}
+	cur, err := u.Service.Files.Get(t.FileID).Context(ctx).SupportsAllDrives(true).
+		Fields("headRevisionId").Do()
+	if err != nil {
+		return false, err
+	}
+	return cur.HeadRevisionId != t.BaseRevision, nil
+}
+
+// ConflictName returns the name of the conflict copy of the file named
+// name, of the form "name (conflict <host> <time>).ext".
+func ConflictName(name string, t time.Time) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s (conflict %s %s)%s",
+		strings.TrimSuffix(name, ext), host, t.Format("2006-01-02 150405"), ext)
+}
+
+// startSession initiates a resumable upload and returns the session URI.
+func (u *Uploader) startSession(ctx context.Context, t UploadTarget, size int64) (string, error) {
+	meta := &drive.File{MimeType: t.MimeType}
+	method, url := http.MethodPost, u.url()
+	if t.FileID != "" {
+		method, url = http.MethodPatch, url+"/"+t.FileID
+	} else {
+		meta.Name = t.Name
+		meta.Parents = []string{t.ParentID}
+	}
+	body, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, method,
+		url+"?uploadType=resumable&supportsAllDrives=true&fields="+strings.ReplaceAll(uploadFields, " ", ""),
+		bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	if t.MimeType != "" {
+		req.Header.Set("X-Upload-Content-Type", t.MimeType)
+	}
+	resp, err := u.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return "", err
+	}
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return "", errors.New("upload session URI missing from response")
+	}
+	return loc, nil
+}
+
+// sendChunk sends the chunk of f starting at e.Offset. It returns the
+// uploaded file once Drive has the whole content, or else the offset
+// to send the next chunk from.
+func (u *Uploader) sendChunk(ctx context.Context, e *journalEntry, f *os.File) (*drive.File, int64, error) {
+	n := u.chunkSize()
+	if e.Offset+n > e.Size {
+		n = e.Size - e.Offset
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, e.SessionURI,
+		io.NewSectionReader(f, e.Offset, n))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.ContentLength = n
+	if n == 0 {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", e.Size))
+	} else {
+		req.Header.Set("Content-Range",
+			fmt.Sprintf("bytes %d-%d/%d", e.Offset, e.Offset+n-1, e.Size))
+	}
+	res, offset, err := u.do(req)
+	if err == nil {
+		uploadedBytes.Add(float64(n))
+	}
+	return res, offset, err
+}
+
+// status asks Drive how much of the upload it has received.
+func (u *Uploader) status(ctx context.Context, e *journalEntry) (*drive.File, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, e.SessionURI, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", e.Size))
+	return u.do(req)
+}
+
+// do sends a request to an upload session and interprets the response.
+func (u *Uploader) do(req *http.Request) (*drive.File, int64, error) {
+	resp, err := u.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		res := &drive.File{}
+		if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+			return nil, 0, err
+		}
+		return res, 0, nil
+	case http.StatusPermanentRedirect: // "Resume Incomplete"
+		// Range is "bytes=0-<last byte received>", absent if none were.
+		r := resp.Header.Get("Range")
+		if r == "" {
+			return nil, 0, nil
+		}
+		i := strings.LastIndex(r, "-")
+		last, err := strconv.ParseInt(r[i+1:], 10, 64)
+		if i < 0 || err != nil {
+			return nil, 0, fmt.Errorf("bad Range header in upload response: %q", r)
+		}
+		return nil, last + 1, nil
+	case http.StatusNotFound, http.StatusGone:
+		return nil, 0, errSessionExpired
+	}
+	return nil, 0, googleapi.CheckResponse(resp)
+}
+
+func (u *Uploader) url() string {
+	if u.URL != "" {
+		return u.URL
+	}
+	return uploadURL
+}
+
+func (u *Uploader) chunkSize() int64 {
+	if u.ChunkSize <= 0 {
+		return DefaultChunkSize
+	}
+	return u.ChunkSize
+}
+
+// retryable reports whether a request that failed with err may succeed if
+// sent again.
+func retryable(err error) bool {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code == http.StatusTooManyRequests || gerr.Code >= 500
+	}
+	return err != errSessionExpired && err != context.Canceled &&
+		err != context.DeadlineExceeded
+}
+
+// backoff returns how long to wait before the given retry, starting at a
+// second and doubling up to 32 seconds.
+func backoff(retry int) time.Duration {
+	if retry > 6 {
+		retry = 6
+	}
+	return time.Second << uint(retry-1)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Journal persists the upload sessions in progress in a directory, one
+// JSON file per local file being uploaded.
+type Journal struct {
+	dir string
+}
+
+type journalEntry struct {
+	Path string
+	// Target is where the content goes, which differs from the Original
+	// target passed to Upload if it goes to a conflict copy.
+	Target     UploadTarget
+	Original   UploadTarget
+	Size       int64
+	ModTime    time.Time
+	SessionURI string
+	Offset     int64
+	Started    time.Time
+}
+
+// NewJournal returns a journal kept in dir, creating it if needed.
+func NewJournal(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Journal{dir: dir}, nil
+}
+
+func (j *Journal) entryPath(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(j.dir, hex.EncodeToString(sum[:8])+".json")
+}
+
+// load returns the entry for the upload of the local file at path, or nil
+// if there is none.
+func (j *Journal) load(path string) (*journalEntry, error) {
+	b, err := os.ReadFile(j.entryPath(path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	e := &journalEntry{}
+	if err := json.Unmarshal(b, e); err != nil || e.Path != path {
+		// A corrupt entry only costs a restart of the upload.
+		return nil, nil
+	}
+	return e, nil
+}
+
+func (j *Journal) save(e *journalEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(j.entryPath(e.Path), b, 0600)
+}
+
+func (j *Journal) remove(path string) error {
+	err := os.Remove(j.entryPath(path))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it
+// over path, so that readers never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,238 @@
+package driveapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+// fakeUploadServer implements the Drive resumable upload protocol for a
+// single session. If failAt is set, the connection is dropped as soon as a
+// chunk starting at that offset is received, after storing half of it.
+type fakeUploadServer struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	sessions int
+	received []byte
+	size     int64
+	failAt   int64
+	failed   bool
+}
+
+func (s *fakeUploadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.URL.Query().Get("uploadType") == "resumable" {
+		s.sessions++
+		s.received = nil
+		s.size, _ = strconv.ParseInt(r.Header.Get("X-Upload-Content-Length"), 10, 64)
+		w.Header().Set("Location", "http://"+r.Host+"/session")
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	cr := r.Header.Get("Content-Range")
+	if !strings.HasPrefix(cr, "bytes */") {
+		var start, end, total int64
+		fmt.Sscanf(cr, "bytes %d-%d/%d", &start, &end, &total)
+		if start != int64(len(s.received)) {
+			s.t.Errorf("chunk starts at %d, want %d", start, len(s.received))
+		}
+		if start == s.failAt && s.failAt > 0 && !s.failed {
+			s.failed = true
+			s.received = append(s.received, body[:len(body)/2]...)
+			hj, _ := w.(http.Hijacker)
+			c, _, _ := hj.Hijack()
+			c.Close()
+			return
+		}
+		s.received = append(s.received, body...)
+	}
+	if int64(len(s.received)) == s.size {
+		fmt.Fprintf(w, `{"id": "new-id", "size": "%d", "md5Checksum": "abc", "version": "7"}`, s.size)
+		return
+	}
+	if len(s.received) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(s.received)-1))
+	}
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+func TestUploader_Upload(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), ChunkAlign*3/16+100)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		failAt int64
+	}{
+		{name: "uninterrupted"},
+		{name: "connection dropped mid chunk", failAt: 2 * ChunkAlign},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeUploadServer{t: t, failAt: tt.failAt}
+			srv := httptest.NewServer(fake)
+			defer srv.Close()
+			j, err := NewJournal(filepath.Join(dir, "journal-"+strconv.FormatInt(tt.failAt, 10)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			u := &Uploader{
+				Client:     srv.Client(),
+				URL:        srv.URL,
+				ChunkSize:  ChunkAlign,
+				Journal:    j,
+				MaxRetries: 1,
+			}
+			res, err := u.Upload(context.TODO(), UploadTarget{Name: "data.bin", ParentID: "root"}, path)
+			if err != nil {
+				t.Fatalf("Upload() error = %v", err)
+			}
+			if res.Id != "new-id" || res.Version != 7 {
+				t.Errorf("Upload() = %+v", res)
+			}
+			if !bytes.Equal(fake.received, content) {
+				t.Errorf("server received %d bytes, want %d", len(fake.received), len(content))
+			}
+			if fake.sessions != 1 {
+				t.Errorf("started %d upload sessions, want 1", fake.sessions)
+			}
+			if e, _ := j.load(path); e != nil {
+				t.Errorf("journal entry left after upload: %+v", e)
+			}
+		})
+	}
+}
+
+func TestUploader_ResumeFromJournal(t *testing.T) {
+	content := bytes.Repeat([]byte{'x'}, 2*ChunkAlign+10)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeUploadServer{t: t}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	j, err := NewJournal(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &Uploader{Client: srv.Client(), URL: srv.URL, ChunkSize: ChunkAlign, Journal: j}
+	target := UploadTarget{Name: "data.bin", ParentID: "root"}
+
+	// Simulate a process that was stopped after sending the first chunk.
+	st, _ := os.Stat(path)
+	e := &journalEntry{Path: path, Target: target, Original: target,
+		Size: st.Size(), ModTime: st.ModTime(), Started: st.ModTime()}
+	if e.SessionURI, err = u.startSession(context.TODO(), target, e.Size); err != nil {
+		t.Fatalf("startSession() error = %v", err)
+	}
+	f, _ := os.Open(path)
+	_, e.Offset, err = u.sendChunk(context.TODO(), e, f)
+	f.Close()
+	if err != nil || e.Offset != ChunkAlign {
+		t.Fatalf("sendChunk() = %d, %v", e.Offset, err)
+	}
+	if err := j.save(e); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := u.Upload(context.TODO(), target, path); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	if fake.sessions != 1 {
+		t.Errorf("started %d upload sessions, want the journaled one resumed", fake.sessions)
+	}
+	if !bytes.Equal(fake.received, content) {
+		t.Errorf("server received %d bytes, want %d", len(fake.received), len(content))
+	}
+}
+
+func TestUploader_Conflict(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "report.txt")
+	if err := os.WriteFile(path, []byte("local edit"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		baseRevision string
+		wantConflict bool
+	}{
+		{name: "unchanged on Drive", baseRevision: "rev1"},
+		{name: "changed on Drive", baseRevision: "rev0", wantConflict: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var session string
+			var meta drive.File
+			fake := &fakeUploadServer{t: t}
+			mux := http.NewServeMux()
+			mux.HandleFunc("/files/fid1", func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, `{"headRevisionId": "rev1"}`)
+			})
+			mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&meta)
+				fake.ServeHTTP(w, r)
+			})
+			mux.HandleFunc("/upload/", func(w http.ResponseWriter, r *http.Request) {
+				session = r.Method + " " + r.URL.Path
+				fake.ServeHTTP(w, r)
+			})
+			mux.Handle("/session", fake)
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+			svc, err := drive.NewService(context.TODO(),
+				option.WithHTTPClient(srv.Client()), option.WithEndpoint(srv.URL))
+			if err != nil {
+				t.Fatal(err)
+			}
+			j, err := NewJournal(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			u := &Uploader{Client: srv.Client(), Service: svc, URL: srv.URL + "/upload", Journal: j}
+
+			target := UploadTarget{FileID: "fid1", Name: "report.txt", ParentID: "root",
+				BaseRevision: tt.baseRevision}
+			if _, err := u.Upload(context.TODO(), target, path); err != nil {
+				t.Fatalf("Upload() error = %v", err)
+			}
+			if !tt.wantConflict {
+				if session != "PATCH /upload/fid1" {
+					t.Errorf("upload session started with %q, want an update of fid1", session)
+				}
+				return
+			}
+			if session != "" {
+				t.Errorf("upload session started with %q, want a new file", session)
+			}
+			if !strings.HasPrefix(meta.Name, "report (conflict ") || !strings.HasSuffix(meta.Name, ").txt") {
+				t.Errorf("conflict copy named %q", meta.Name)
+			}
+			if len(meta.Parents) != 1 || meta.Parents[0] != "root" {
+				t.Errorf("conflict copy parents = %v, want [root]", meta.Parents)
+			}
+		})
+	}
+}
@@ -1,73 +1,436 @@
+// Command drivefs mounts Google Drive as a FUSE filesystem, and also reads
+// and writes Drive files from the command line where FUSE is not
+// available.
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
 	"github.com/althk/drivefs/driveapi"
-	"github.com/althk/drivefs/fusehooks"
+	"github.com/althk/drivefs/logging"
+	"github.com/althk/drivefs/writeback"
 	"google.golang.org/api/drive/v3"
 )
 
-var (
-	mountPath       = flag.String("mntpoint", "", "Mount dir for GDrive")
-	credentialsPath = flag.String("credsfile", "", "Path to creds json file")
-	tokenPath       = flag.String("tokenfile", "", "Path to oauth token")
-)
-var svc *drive.Service
+// passphraseEnv is the environment variable holding the passphrase of an
+// encrypted token file.
+const passphraseEnv = "DRIVEFS_TOKEN_PASSPHRASE"
+
+var logger *logging.Logger
+
+// options are the settings of a drivefs command. Every command registers
+// the flags of the settings it uses.
+type options struct {
+	configPath string
+	profile    string
+
+	credentialsPath string
+	tokenPath       string
+	tokenStore      string
+	passphraseFD    int
+	authFlow        string
+	impersonate     string
+	root            string
+	logLevel        string
+	logFormat       string
+	logFile         string
+
+	mountPath     string
+	mountOpts     mountOptions
+	cacheSize     int64
+	cacheDir      string
+	readWrite     bool
+	chunkSize     int64
+	uploadWorkers int
+	writeMode     string
+	metricsAddr   string
+	listTTL       time.Duration
+
+	shutdownTimeout time.Duration
+	daemon          bool
+	pidFile         string
+
+	// values are the values of all the flags of the command once the
+	// profile is applied.
+	values map[string]string
+	// args are the arguments of the command, parsed again to reload the
+	// configuration.
+	args []string
+}
+
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "drivefs")
+}
+
+// configFlags registers the flags choosing the configuration profile,
+// which all commands have.
+func (o *options) configFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.configPath, "config", defaultConfigPath(), "Path to the configuration file")
+	fs.StringVar(&o.profile, "profile", "", "Configuration profile to use (default the default_profile of the configuration)")
+}
+
+// isSetting reports whether name is a flag that can be set in a profile.
+func isSetting(name string) bool {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	(&options{}).mountFlags(fs)
+	return fs.Lookup(name) != nil
+}
+
+// authFlags registers the flags of the settings needed to call Drive.
+func (o *options) authFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.credentialsPath, "credsfile", "", "Path to creds json file")
+	fs.StringVar(&o.tokenPath, "tokenfile", "", "Path to oauth token (not needed with a service account key)")
+	fs.StringVar(&o.tokenStore, "tokenstore", "file", "Where the oauth token is kept: file (plain JSON in -tokenfile), encrypted (-tokenfile encrypted with a passphrase) or keyring (the Secret Service keyring, under the name -tokenfile)")
+	fs.IntVar(&o.passphraseFD, "passphrase-fd", -1, "File descriptor to read the token passphrase from, instead of the "+passphraseEnv+" environment variable")
+	fs.StringVar(&o.authFlow, "authflow", driveapi.FlowLoopback, "How to authorize on first run: loopback (open a link in a browser on this machine) or device (enter a code on any device; Google only allows it to grant access to the files drivefs creates)")
+	fs.StringVar(&o.impersonate, "impersonate", "", "Email of the user a service account acts as through domain-wide delegation")
+}
+
+// rootFlag registers the flag of the Drive folder commands work in.
+func (o *options) rootFlag(fs *flag.FlagSet) {
+	fs.StringVar(&o.root, "root", "", "Drive folder to use as the root: a path from My Drive starting with /, a shared drive name or a folder ID (default My Drive)")
+}
+
+// logFlags registers the flags of the logging settings.
+func (o *options) logFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.logLevel, "loglevel", "info", "Minimum level of logged messages: debug, info, warn or error")
+	fs.StringVar(&o.logFormat, "logformat", "text", "Format of log messages: text or json")
+}
+
+// daemonFlags registers the flags of running in the background.
+func (o *options) daemonFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.daemon, "daemon", false, "Run in the background once mounted, logging to -logfile")
+	fs.StringVar(&o.pidFile, "pidfile", "", "File to write the process ID to while mounted")
+	fs.StringVar(&o.logFile, "logfile", "", "File to append log messages to instead of stderr (default drivefs.log in -cachedir with -daemon)")
+}
+
+// cacheDirFlag registers the flag of the local cache dir.
+func (o *options) cacheDirFlag(fs *flag.FlagSet) {
+	fs.StringVar(&o.cacheDir, "cachedir", defaultCacheDir(), "Dir for local copies of written files and the upload journal")
+}
+
+// mountFlags registers the flags of the mount settings.
+func (o *options) mountFlags(fs *flag.FlagSet) {
+	o.authFlags(fs)
+	o.logFlags(fs)
+	o.cacheDirFlag(fs)
+	o.rootFlag(fs)
+	o.daemonFlags(fs)
+	fs.StringVar(&o.mountPath, "mntpoint", "", "Mount dir for GDrive (or give it as the first argument)")
+	fs.Var(&o.mountOpts, "o", "Comma-separated mount options: allow_other, default_permissions, ro, uid=N, gid=N, umask=OCTAL, fsname=NAME, subtype=NAME, max_readahead=BYTES")
+	fs.Int64Var(&o.cacheSize, "cachesize", 256, "In-memory file content cache size in MiB")
+	fs.DurationVar(&o.listTTL, "listttl", driveapi.DefaultListTTL, "How long folder listings are cached before they are fetched from Drive again")
+	fs.BoolVar(&o.readWrite, "readwrite", false, "Allow creating and writing files")
+	fs.Int64Var(&o.chunkSize, "chunksize", 8, "Upload chunk size in MiB")
+	fs.IntVar(&o.uploadWorkers, "uploadworkers", 2, "Number of files uploaded in parallel")
+	fs.StringVar(&o.writeMode, "writemode", "async", "When closed files are uploaded: async (in the background) or sync (before close returns)")
+	fs.DurationVar(&o.shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait on shutdown for file operations in progress, and then for pending uploads (the rest are resumed by the next mount)")
+	fs.StringVar(&o.metricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics on at /metrics, e.g. localhost:9101 (disabled if empty)")
+}
+
+// fileFlags registers the flags of the commands working on Drive files.
+func (o *options) fileFlags(fs *flag.FlagSet) {
+	o.authFlags(fs)
+	o.rootFlag(fs)
+}
+
+// command is a drivefs subcommand.
+type command struct {
+	name    string
+	args    string // synopsis of the positional arguments
+	summary string
+	flags   func(o *options, fs *flag.FlagSet)
+	run     func(ctx context.Context, o *options, args []string) error
+}
+
+// errUsage is returned by commands given the wrong arguments.
+var errUsage = errors.New("usage")
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"mount", "[mountpoint|profile]", "Mount Drive at mountpoint, or as configured by a profile",
+			(*options).mountFlags, runMount},
+		{"auth", "", "Authorize drivefs and save the oauth token",
+			(*options).authFlags, runAuth},
+		{"unmount", "mountpoint", "Unmount a drivefs mount",
+			func(*options, *flag.FlagSet) {}, runUnmount},
+		{"status", "[mountpoint]", "Show the status of a mount, or the pending uploads in -cachedir",
+			(*options).cacheDirFlag, runStatus},
+		{"ls", "[path]", "List a Drive folder",
+			(*options).fileFlags, runLs},
+		{"get", "path [local path|-]", "Download a Drive file",
+			(*options).fileFlags, runGet},
+		{"put", "local-path path", "Upload a file to Drive, replacing any file at path",
+			func(o *options, fs *flag.FlagSet) {
+				o.fileFlags(fs)
+				o.cacheDirFlag(fs)
+				fs.Int64Var(&o.chunkSize, "chunksize", 8, "Upload chunk size in MiB")
+			}, runPut},
+		{"rm", "path...", "Move Drive files to the trash",
+			(*options).fileFlags, runRm},
+	}
+}
+
+// commandNamed returns the command with the given name, nil if there is
+// none.
+func commandNamed(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: drivefs <command> [flags] [arguments]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-8s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(w, "\nRun drivefs <command> -h for the flags of a command.\n")
+}
 
 func main() {
-	flag.Parse()
-	if flag.NFlag() != 3 {
-		flag.Usage()
+	args := os.Args[1:]
+	if isHelper(os.Args[0], args) {
+		margs, err := helperArgs(args, func(config, name string) bool {
+			if config == "" {
+				config = defaultConfigPath()
+			}
+			c, err := loadConfig(config, false)
+			return err == nil && c.hasProfile(name)
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "drivefs:", err)
+			os.Exit(2)
+		}
+		if margs == nil {
+			return
+		}
+		args = append([]string{"mount"}, margs...)
+	}
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "help" {
+		usage()
+		os.Exit(2)
+	}
+	// Before it had commands, drivefs only mounted, configured by flags.
+	name := "mount"
+	if !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd := commandNamed(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "drivefs: unknown command %q\n\n", name)
+		usage()
 		os.Exit(2)
 	}
 
-	// Handle program interruption (signint) so that we can
-	// cleanly unmount FUSE fs before exiting.
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
-	defer stop()
+	o, fs, args, err := parseFlags(cmd, args, flag.ExitOnError)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "drivefs:", err)
+		os.Exit(2)
+	}
+	if err := setupLogger(o); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-	b, err := os.ReadFile(*credentialsPath)
+	// Handle program interruption (SIGINT) and systemctl stop (SIGTERM)
+	// so that we can cleanly unmount FUSE fs before exiting. A second
+	// signal kills the program without waiting.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	err = cmd.run(ctx, o, args)
+	if err == errUsage {
+		fs.Usage()
+		os.Exit(2)
+	}
 	if err != nil {
-		log.Fatalf("Unable to read credentials.json: %v", err)
+		reportMounted(err)
+		fatal("drivefs "+cmd.name+" failed", err)
 	}
-	svc = driveapi.InitWithConfigJSON(ctx, b, *tokenPath)
-	fmt.Println("Drive client initialized")
+}
 
-	if err := mount(ctx, stop, *mountPath); err != nil {
-		log.Fatalf("Mount err: %v\n", err)
+// parseFlags parses the flags of cmd in args and applies the configuration
+// profile, returning the settings and the remaining arguments.
+func parseFlags(cmd *command, args []string, handling flag.ErrorHandling) (*options, *flag.FlagSet, []string, error) {
+	o := &options{logLevel: "info", logFormat: "text", args: args}
+	fs := flag.NewFlagSet("drivefs "+cmd.name, handling)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: drivefs %s [flags] %s\n\n%s.\n\n", cmd.name, cmd.args, cmd.summary)
+		fs.PrintDefaults()
+	}
+	o.configFlags(fs)
+	cmd.flags(o, fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, nil, err
 	}
+	args = fs.Args()
+	if err := applyProfile(cmd, o, fs, &args); err != nil {
+		return nil, nil, nil, err
+	}
+	return o, fs, args, nil
 }
 
-func mount(ctx context.Context, stop context.CancelFunc, mnt string) error {
-	c, err := fuse.Mount(mnt)
+// applyProfile applies the configuration profile chosen by -profile, by
+// the argument of mount, or by default. For mount, an argument naming a
+// profile is consumed.
+func applyProfile(cmd *command, o *options, fs *flag.FlagSet, args *[]string) error {
+	explicit := false
+	fs.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "config" })
+	c, err := loadConfig(o.configPath, explicit)
 	if err != nil {
 		return err
 	}
-	go func() {
-		<-ctx.Done() // Program interrupted
-		_ = fuse.Unmount(mnt)
-		_ = c.Close()
-		fmt.Println("Program interrupted")
-		stop()
+	if o.profile == "" && cmd.name == "mount" && len(*args) == 1 && c.hasProfile((*args)[0]) {
+		o.profile, *args = (*args)[0], nil
+	}
+	if o.profile == "" {
+		o.profile = c.DefaultProfile
+	}
+	if o.profile != "" {
+		if err := c.apply(o.profile, fs, isSetting); err != nil {
+			return err
+		}
+	}
+	o.values = make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		o.values[f.Name] = f.Value.String()
+	})
+	return nil
+}
 
-	}()
+// setupLogger creates the logger of the logging settings, used by all the
+// packages.
+func setupLogger(o *options) error {
+	level, err := logging.ParseLevel(o.logLevel)
+	if err != nil {
+		return err
+	}
+	format, err := logging.ParseFormat(o.logFormat)
+	if err != nil {
+		return err
+	}
+	if o.daemon && o.logFile == "" {
+		o.logFile = filepath.Join(o.cacheDir, "drivefs.log")
+	}
+	var w io.Writer = os.Stderr
+	// With -daemon, the process started in the foreground reports to the
+	// terminal and only the one in the background logs to the file.
+	if o.logFile != "" && (!o.daemon || isDaemon()) {
+		if err := os.MkdirAll(filepath.Dir(o.logFile), 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(o.logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	logger = logging.New(w, level, format)
+	driveapi.SetLogger(logger)
+	writeback.SetLogger(logger)
+	return nil
+}
 
-	// Unmount first, then close the FUSE conn.
-	defer fuse.Unmount(mnt)
-	defer c.Close()
+// fatal logs an error and exits.
+func fatal(msg string, err error) {
+	logger.Error(msg, "err", err)
+	os.Exit(1)
+}
 
-	dfs := &fusehooks.FS{Ctx: ctx, DriveSvc: svc}
-	if err := fs.Serve(c, dfs); err != nil {
-		_ = fuse.Unmount(mnt)
-		fmt.Printf("serving ended: %v", err)
+// newClient returns an HTTP client authorized to call Drive with the auth
+// settings.
+func newClient(o *options) (*http.Client, error) {
+	if o.credentialsPath == "" {
+		return nil, errUsage
 	}
-	return nil
+	b, err := os.ReadFile(o.credentialsPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read credentials: %w", err)
+	}
+	opts := driveapi.AuthOptions{Subject: o.impersonate, Flow: o.authFlow}
+	if isDaemon() {
+		// There is no terminal to ask the user on.
+		opts.Flow = driveapi.FlowNone
+	}
+	if !driveapi.IsServiceAccount(b) {
+		if o.tokenPath == "" {
+			return nil, errors.New("-tokenfile is required unless -credsfile is a service account key")
+		}
+		if opts.Store, err = newTokenStore(o); err != nil {
+			return nil, err
+		}
+	}
+	return driveapi.NewClient(b, opts)
+}
+
+// newService returns a Drive service using client.
+func newService(ctx context.Context, client *http.Client) (*drive.Service, error) {
+	svc, err := driveapi.NewService(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Drive client initialized")
+	return svc, nil
+}
+
+// newTokenStore returns the store of the oauth token chosen by -tokenstore.
+func newTokenStore(o *options) (driveapi.TokenStore, error) {
+	switch o.tokenStore {
+	case "file":
+		return driveapi.NewFileTokenStore(o.tokenPath), nil
+	case "encrypted":
+		passphrase, err := readPassphrase(o.passphraseFD)
+		if err != nil {
+			return nil, err
+		}
+		return driveapi.NewEncryptedTokenStore(o.tokenPath, passphrase), nil
+	case "keyring":
+		return driveapi.NewKeyringTokenStore(o.tokenPath), nil
+	}
+	return nil, fmt.Errorf("unknown token store %q", o.tokenStore)
+}
+
+// readPassphrase returns the token passphrase, read from the file
+// descriptor fd up to the first newline if it is not negative, or else from
+// the environment.
+func readPassphrase(fd int) ([]byte, error) {
+	if fd < 0 {
+		if p := os.Getenv(passphraseEnv); p != "" {
+			return []byte(p), nil
+		}
+		return nil, fmt.Errorf("set %s or -passphrase-fd to use an encrypted token", passphraseEnv)
+	}
+	f := os.NewFile(uintptr(fd), "passphrase")
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("unable to read passphrase: %w", err)
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
 }
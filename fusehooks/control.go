@@ -0,0 +1,312 @@
+package fusehooks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/althk/drivefs/driveapi"
+)
+
+// controlDirName is the name of the virtual directory at the mount root
+// that exposes the state of the mount. It only exists in the mount and is
+// never synced to Drive.
+const controlDirName = ".drivefs"
+
+// maxErrors is the number of recent errors kept for .drivefs/errors.
+const maxErrors = 100
+
+type errorEntry struct {
+	time time.Time
+	op   string
+	name string
+	err  error
+}
+
+// errorLog keeps the most recent errors returned by the mount.
+type errorLog struct {
+	mu      sync.Mutex
+	entries []errorEntry
+}
+
+func (l *errorLog) add(e errorEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) == maxErrors {
+		l.entries = append(l.entries[:0], l.entries[1:]...)
+	}
+	l.entries = append(l.entries, e)
+}
+
+func (l *errorLog) snapshot() []errorEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]errorEntry(nil), l.entries...)
+}
+
+// fail records err, if any, as a failure of op on the named file and
+// returns it, as EACCES if Drive no longer accepts the credentials.
+func (f *FS) fail(op, name string, err error) error {
+	if err != nil && f != nil {
+		f.errs.add(errorEntry{time: time.Now(), op: op, name: name, err: err})
+		f.Log.Warn("operation failed", "op", op, "name", name, "err", err)
+	}
+	if errors.Is(err, driveapi.ErrAuthRevoked) {
+		return fuse.Errno(syscall.EACCES)
+	}
+	return err
+}
+
+// ControlDir is the .drivefs directory. Its files are generated when read,
+// and writing a path to its writable files acts on that path.
+type ControlDir struct {
+	fs *FS
+}
+
+var _ fs.Node = (*ControlDir)(nil)
+
+func (cd *ControlDir) Attr(_ context.Context, attr *fuse.Attr) error {
+	attr.Mode = os.ModeDir | 0500
+	cd.fs.own(attr)
+	attr.Mtime = cd.fs.started
+	attr.Ctime = cd.fs.started
+	return nil
+}
+
+func (cd *ControlDir) files() []*ControlFile {
+	files := []*ControlFile{
+		{name: "status", read: cd.fs.status},
+		{name: "errors", read: cd.fs.errorReport},
+		{name: "config", read: cd.fs.config},
+		{name: "invalidate", write: cd.fs.invalidate},
+		{name: "refresh", write: cd.fs.refresh},
+	}
+	for _, cf := range files {
+		cf.fs = cd.fs
+	}
+	return files
+}
+
+var _ = fs.HandleReadDirAller(&ControlDir{})
+
+func (cd *ControlDir) ReadDirAll(context.Context) ([]fuse.Dirent, error) {
+	var res []fuse.Dirent
+	for _, cf := range cd.files() {
+		res = append(res, fuse.Dirent{Name: cf.name, Type: fuse.DT_File})
+	}
+	return res, nil
+}
+
+var _ = fs.NodeRequestLookuper(&ControlDir{})
+
+func (cd *ControlDir) Lookup(
+	_ context.Context, req *fuse.LookupRequest,
+	_ *fuse.LookupResponse) (fs.Node, error) {
+	for _, cf := range cd.files() {
+		if cf.name == req.Name {
+			return cf, nil
+		}
+	}
+	return nil, fuse.ToErrno(syscall.ENOENT)
+}
+
+// ControlFile is a file in the .drivefs directory. It is either read-only,
+// with read generating its content, or write-only, with write called for
+// every path written to it, one per line.
+type ControlFile struct {
+	fs    *FS
+	name  string
+	read  func(ctx context.Context) []byte
+	write func(ctx context.Context, path string) error
+}
+
+var _ fs.Node = (*ControlFile)(nil)
+
+// Attr reports a size of 0, as generating the content may take API calls.
+// Control files are opened with direct I/O, so reads go on until the end of
+// the content regardless.
+func (cf *ControlFile) Attr(_ context.Context, attr *fuse.Attr) error {
+	attr.Mtime = time.Now()
+	attr.Ctime = time.Now()
+	cf.fs.own(attr)
+	if cf.write != nil {
+		attr.Mode = 0200
+		return nil
+	}
+	attr.Mode = 0400
+	return nil
+}
+
+var _ = fs.NodeOpener(&ControlFile{})
+
+func (cf *ControlFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if req.Flags.IsReadOnly() != (cf.read != nil) {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+	// The content changes on every read, so it must not be cached.
+	resp.Flags |= fuse.OpenDirectIO
+	h := &ControlHandle{cf: cf}
+	if cf.read != nil {
+		h.data = cf.read(ctx)
+	}
+	return h, nil
+}
+
+// ControlHandle is an open control file. Reads see the content generated
+// when it was opened.
+type ControlHandle struct {
+	cf   *ControlFile
+	data []byte
+}
+
+var _ = fs.HandleReader(&ControlHandle{})
+
+func (ch *ControlHandle) Read(_ context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	if req.Offset >= int64(len(ch.data)) {
+		return nil
+	}
+	end := req.Offset + int64(req.Size)
+	if end > int64(len(ch.data)) {
+		end = int64(len(ch.data))
+	}
+	resp.Data = ch.data[req.Offset:end]
+	return nil
+}
+
+var _ = fs.HandleWriter(&ControlHandle{})
+
+func (ch *ControlHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	for _, line := range strings.Split(string(req.Data), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if err := ch.cf.write(ctx, line); err != nil {
+			return err
+		}
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
+
+// status reports how the mount is doing.
+func (f *FS) status(ctx context.Context) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "uptime: %v\n", time.Since(f.started).Round(time.Second))
+	if account := f.account(ctx); account != "" {
+		fmt.Fprintf(&b, "account: %s\n", account)
+	}
+	if f.Calls != nil {
+		counts, errors := f.Calls.Counts()
+		var calls []string
+		for _, c := range counts {
+			calls = append(calls, fmt.Sprintf("%s %d", c.Method, c.Calls))
+		}
+		fmt.Fprintf(&b, "api calls: %s (%d failed)\n", strings.Join(calls, ", "), errors)
+	}
+	if f.Cache != nil {
+		st := f.Cache.Stats()
+		fmt.Fprintf(&b, "cache: %d blocks, %d of %d MiB, hit ratio %.2f\n",
+			st.Blocks, st.Size>>20, st.Budget>>20, st.HitRatio())
+	}
+	if f.Queue != nil {
+		items := f.Queue.Items()
+		fmt.Fprintf(&b, "pending uploads: %d\n", len(items))
+		for _, it := range items {
+			fmt.Fprintf(&b, "  %s (%d bytes, queued %s, %d attempts)\n", it.Target.Name,
+				it.Size, it.Queued.Format(time.RFC3339), it.Attempts)
+		}
+	}
+	return b.Bytes()
+}
+
+// account returns the email address of the Drive account, fetching it the
+// first time it is needed.
+func (f *FS) account(ctx context.Context) string {
+	f.accountMu.Lock()
+	defer f.accountMu.Unlock()
+	if f.accountEmail == "" && f.DriveSvc != nil {
+		email, err := driveapi.Account(ctx, f.DriveSvc)
+		if err != nil {
+			return ""
+		}
+		f.accountEmail = email
+	}
+	return f.accountEmail
+}
+
+// errorReport lists the recent errors of the mount, oldest first, followed
+// by the uploads whose last attempt failed.
+func (f *FS) errorReport(context.Context) []byte {
+	var b bytes.Buffer
+	for _, e := range f.errs.snapshot() {
+		fmt.Fprintf(&b, "%s %s %s: %v\n", e.time.Format(time.RFC3339), e.op, e.name, e.err)
+	}
+	if f.Queue != nil {
+		for _, it := range f.Queue.Items() {
+			if it.LastError != "" {
+				fmt.Fprintf(&b, "upload %s (attempt %d, next at %s): %s\n", it.Target.Name,
+					it.Attempts, it.NextAttempt.Format(time.RFC3339), it.LastError)
+			}
+		}
+	}
+	return b.Bytes()
+}
+
+// config lists the settings the mount was started with.
+func (f *FS) config(context.Context) []byte {
+	keys := make([]string, 0, len(f.Config))
+	for k := range f.Config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s = %s\n", k, f.Config[k])
+	}
+	return b.Bytes()
+}
+
+// lookupPath returns the file at path, relative to the mount root.
+func (f *FS) lookupPath(ctx context.Context, path string) (driveapi.File, error) {
+	file, err := driveapi.Lookup(ctx, f.root, path)
+	if err == driveapi.ErrNotFound {
+		return nil, fuse.ToErrno(syscall.ENOENT)
+	}
+	return file, err
+}
+
+// invalidate drops what is cached about the file or directory at path, so
+// that it is fetched from Drive again when next used.
+func (f *FS) invalidate(ctx context.Context, path string) error {
+	file, err := f.lookupPath(ctx, path)
+	if err != nil {
+		return f.fail("invalidate", path, err)
+	}
+	file.Invalidate()
+	if !file.IsDir() && f.Cache != nil {
+		f.Cache.Invalidate(file.ID())
+	}
+	return nil
+}
+
+// refresh lists the directory at path from Drive again right away.
+func (f *FS) refresh(ctx context.Context, path string) error {
+	file, err := f.lookupPath(ctx, path)
+	if err == nil && !file.IsDir() {
+		err = fuse.Errno(syscall.ENOTDIR)
+	}
+	if err == nil {
+		file.Invalidate()
+		_, err = file.ListFiles(ctx)
+	}
+	return f.fail("refresh", path, err)
+}
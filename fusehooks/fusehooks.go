@@ -3,66 +3,165 @@ package fusehooks
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"io"
 	"os"
+	"sync"
 	"syscall"
 	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+	"github.com/althk/drivefs/cache"
 	"github.com/althk/drivefs/driveapi"
+	"github.com/althk/drivefs/logging"
+	"github.com/althk/drivefs/writeback"
 	"google.golang.org/api/drive/v3"
 )
 
 type FS struct {
 	Ctx      context.Context
 	DriveSvc *drive.Service
+	// Folder is the Drive folder exposed as the root of the mount, in any
+	// form driveapi.Folder accepts. The whole of My Drive is exposed if it
+	// is empty.
+	Folder string
+	// Perms sets the owner and permissions of the files. If nil, they are
+	// only accessible by their owner.
+	Perms *Perms
+	// Cache holds the file content blocks read through the mount. It may
+	// be nil, in which case blocks are only kept while a file is open.
+	Cache *cache.BlockCache
+	// Uploader uploads the files written through the mount. The mount is
+	// read-only if it is nil.
+	Uploader *driveapi.Uploader
+	// StageDir is where local copies of the files open for writing are kept.
+	StageDir string
+	// Queue uploads closed files in the background. Without it, files are
+	// uploaded when closed.
+	Queue *writeback.Queue
+	// SyncOnClose makes close wait until the file is uploaded, as fsync
+	// does, instead of returning once it is in the local stage.
+	SyncOnClose bool
+	// Calls counts the requests sent to Drive, if set.
+	Calls *driveapi.CallCounter
+	// Config is the configuration the mount was started with, as shown in
+	// .drivefs/config.
+	Config map[string]string
+	// Log receives the log of file operations. Nothing is logged if it is
+	// nil.
+	Log *logging.Logger
+
+	started      time.Time
+	root         driveapi.File
+	errs         errorLog
+	accountMu    sync.Mutex
+	accountEmail string
+	quota        quotaCache
+	stageMu      sync.Mutex
+	staged       map[string]*stagedFile // by writeback.Key
 }
 
 var _ fs.FS = (*FS)(nil)
 
+// logger returns the logger of f, which may be nil.
+func (f *FS) logger() *logging.Logger {
+	if f == nil {
+		return nil
+	}
+	return f.Log
+}
+
+// Root returns the root directory of the mount. The Drive folder is only
+// resolved by the first call, so that it can be checked before mounting.
 func (f *FS) Root() (fs.Node, error) {
-	root, err := driveapi.RootFolder(f.Ctx, f.DriveSvc)
-	if root == nil {
-		return nil, err
+	if f.root == nil {
+		root, err := driveapi.Folder(f.Ctx, f.DriveSvc, f.Folder)
+		if root == nil {
+			return nil, err
+		}
+		f.started = time.Now()
+		f.root = root
 	}
 	return &Dir{
-		root,
+		File: f.root,
+		fs:   f,
 	}, nil
 }
 
 type Dir struct {
 	driveapi.File
+	fs *FS
 }
 
 var _ fs.Node = (*Dir)(nil)
 
 func (d *Dir) Attr(_ context.Context, attr *fuse.Attr) error {
-	return mapAttr(d.File, attr)
+	return d.fs.mapAttr(d.File, attr, !d.fs.readOnly())
 }
 
-func mapAttr(f driveapi.File, a *fuse.Attr) error {
-	a.Size = uint64(f.Size())
+// Perms are the owner and permissions of the files of a mount.
+type Perms struct {
+	Uid, Gid uint32
+	// Umask clears permission bits: directories start from 0777 and files
+	// from 0666, without the write bits where they cannot be written.
+	Umask os.FileMode
+}
+
+// mapAttr fills the attributes of a Drive file.
+func (f *FS) mapAttr(file driveapi.File, a *fuse.Attr, writable bool) error {
+	a.Size = uint64(file.Size())
 	a.Mtime = time.Now()
 	a.Ctime = time.Now()
-	if f.IsDir() {
-		a.Mode = os.ModeDir | 0500
+	a.Mode = f.mode(file.IsDir(), writable)
+	f.own(a)
+	return nil
+}
+
+// mode returns the mode of a directory or file of the mount. Without
+// Perms, files are only accessible by their owner.
+func (f *FS) mode(dir, writable bool) os.FileMode {
+	var perm os.FileMode = 0555
+	if writable {
+		perm |= 0222
+	}
+	if f != nil && f.Perms != nil {
+		perm &^= f.Perms.Umask
 	} else {
-		a.Mode = 0400
+		perm &= 0700
 	}
-	return nil
+	if dir {
+		return os.ModeDir | perm
+	}
+	return perm &^ 0111
+}
+
+// own sets the owner of a file of the mount.
+func (f *FS) own(a *fuse.Attr) {
+	if f != nil && f.Perms != nil {
+		a.Uid = f.Perms.Uid
+		a.Gid = f.Perms.Gid
+	}
+}
+
+// isRoot reports whether d is the root of the mount.
+func (d *Dir) isRoot() bool {
+	return d.fs != nil && d.fs.root != nil && d.File == d.fs.root
 }
 
 var _ = fs.HandleReadDirAller(&Dir{})
 
-func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+func (d *Dir) ReadDirAll(ctx context.Context) (_ []fuse.Dirent, err error) {
+	defer observe("readdir", time.Now(), &err)
 
 	files, err := d.ListFiles(ctx)
 	if err != nil {
-		return nil, err
+		return nil, d.fs.fail("readdir", d.Name(), err)
 	}
 	var res []fuse.Dirent
+	if d.isRoot() {
+		res = append(res, fuse.Dirent{Name: controlDirName, Type: fuse.DT_Dir})
+	}
 
 	for _, f := range files {
 		var e fuse.Dirent
@@ -80,64 +179,113 @@ func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 var _ = fs.NodeRequestLookuper(&Dir{})
 
 func (d *Dir) Lookup(
-	_ context.Context, req *fuse.LookupRequest,
-	_ *fuse.LookupResponse) (fs.Node, error) {
+	ctx context.Context, req *fuse.LookupRequest,
+	_ *fuse.LookupResponse) (_ fs.Node, err error) {
+	defer observe("lookup", time.Now(), &err)
 	name := req.Name
-	for _, f := range d.Files() {
+	if name == controlDirName && d.isRoot() {
+		return &ControlDir{fs: d.fs}, nil
+	}
+	// The directory may not have been read yet, or its listing may be
+	// stale, so names are resolved through ListFiles.
+	files, err := d.ListFiles(ctx)
+	if err != nil {
+		return nil, d.fs.fail("lookup", name, err)
+	}
+	for _, f := range files {
 		if f.Name() == name {
 			if f.IsDir() {
 				return &Dir{
-					f,
+					File: f,
+					fs:   d.fs,
 				}, nil
 			}
 			return &File{
-				f,
+				file: f,
+				fs:   d.fs,
 			}, nil
 		}
 	}
+	if rd := d.revisionsDir(files, name); rd != nil {
+		return rd, nil
+	}
 	return nil, fuse.ToErrno(syscall.ENOENT)
 }
 
 type File struct {
 	file driveapi.File
+	fs   *FS
 }
 
 var _ fs.Node = (*File)(nil)
 
 func (f *File) Attr(_ context.Context, attr *fuse.Attr) error {
-	return mapAttr(f.file, attr)
+	if err := f.fs.mapAttr(f.file, attr, !f.fs.readOnly()); err != nil {
+		return err
+	}
+	if size, ok := f.fs.localSize(f.file); ok {
+		attr.Size = uint64(size)
+	}
+	return nil
 }
 
 var _ = fs.NodeOpener(&File{})
 
-func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
-	r, err := f.file.Download(ctx)
-	if err != nil {
-		return nil, err
+func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (_ fs.Handle, err error) {
+	defer observe("open", time.Now(), &err)
+	if !req.Flags.IsReadOnly() || f.fs.isStaged(f.file) {
+		if f.fs.readOnly() {
+			return nil, errReadOnly
+		}
+		sf, err := f.fs.stage(ctx, f.file, req.Flags&fuse.OpenTruncate != 0)
+		if err != nil {
+			return nil, f.fs.fail("open", f.file.Name(), err)
+		}
+		return opened(&WriteHandle{fs: f.fs, sf: sf}), nil
+	}
+	if lf, _, err := f.fs.openQueued(f.file); err != nil || lf != nil {
+		if err != nil {
+			return nil, f.fs.fail("open", f.file.Name(), err)
+		}
+		return opened(&QueuedHandle{lf}), nil
 	}
 	resp.Flags |= fuse.OpenKeepCache
-	return &FileHandle{r}, nil
+	// The reader outlives the open request, so it must not use its context.
+	return opened(&FileHandle{r: newBlockReader(context.Background(), f.file, f.fs.Cache), fs: f.fs}), nil
 }
 
 type FileHandle struct {
-	r io.ReadCloser
+	r  *blockReader
+	fs *FS
 }
 
 var _ fs.Handle = (*FileHandle)(nil)
 
 var _ fs.HandleReleaser = (*FileHandle)(nil)
 
-func (fh *FileHandle) Release(_ context.Context, req *fuse.ReleaseRequest) error {
-	fmt.Println("file handle closed")
+func (fh *FileHandle) Release(_ context.Context, req *fuse.ReleaseRequest) (err error) {
+	defer observe("release", time.Now(), &err)
+	openHandles.Add(-1)
+	fh.fs.logger().Debug("file handle closed", "op", "release", "file", fh.r.file.ID())
 	return fh.r.Close()
 }
 
 var _ = fs.HandleReader(&FileHandle{})
 
-func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	defer observe("read", time.Now(), &err)
+	start := time.Now()
 	buf := make([]byte, req.Size)
-	n, err := fh.r.Read(buf)
-	fmt.Printf("read %d of %d bytes\n", n, req.Size)
+	n, err := fh.r.ReadAt(ctx, buf, req.Offset)
 	resp.Data = buf[:n]
-	return err
+	fh.fs.logger().Debug("read", "op", "read", "file", fh.r.file.ID(), "offset", req.Offset,
+		"size", n, "latency", time.Since(start), "err", err)
+	if err == io.EOF {
+		return nil
+	}
+	if errors.Is(err, driveapi.ErrChecksumMismatch) {
+		fh.fs.fail("read", fh.r.file.Name(), err)
+		return fuse.EIO
+	}
+	return fh.fs.fail("read", fh.r.file.Name(), err)
 }
@@ -3,24 +3,51 @@ package fusehooks
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+	"github.com/althk/drivefs/cache"
 	"github.com/althk/drivefs/driveapi"
+	"github.com/althk/drivefs/metrics"
+	"github.com/althk/drivefs/writeback"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
 )
 
 // mockFile implements driveapi.File interface
 // for testing
 type mockFile struct {
 	name, mimeType, parentName, parentID, id string
+	md5Checksum                              string
 	size                                     uint64
 	isDir, isGoogleAppsFile                  bool
 	content                                  []byte
 	files                                    []driveapi.File
+	description                              string
+	properties, appProperties                map[string]string
+	revisions                                []driveapi.File
+	// headRevision is the head revision the file was listed with, and
+	// driveRevision the one on Drive now, if it changed since.
+	headRevision, driveRevision string
+	// bases are the revisions uploads were based on.
+	bases []string
+	// unlisted hides files from Files until ListFiles is called, as for a
+	// directory that was not read yet.
+	unlisted bool
 }
 
 func (f *mockFile) String() string {
@@ -36,6 +63,7 @@ func (f *mockFile) IsGoogleAppsFile() bool {
 }
 
 func (f *mockFile) ListFiles(ctx context.Context) ([]driveapi.File, error) {
+	f.unlisted = false
 	return f.files, nil
 }
 
@@ -63,11 +91,30 @@ func (f *mockFile) ParentName() string {
 	return f.parentName
 }
 
+func (f *mockFile) MD5Checksum() string {
+	return f.md5Checksum
+}
+
+func (f *mockFile) SHA256Checksum() string {
+	return ""
+}
+
+func (f *mockFile) Version() int64 {
+	return 1
+}
+
+func (f *mockFile) HeadRevisionID() string {
+	return f.headRevision
+}
+
 func (f *mockFile) Content() []byte {
 	return f.content
 }
 
 func (f *mockFile) Files() []driveapi.File {
+	if f.unlisted {
+		return nil
+	}
 	return f.files
 }
 
@@ -75,6 +122,87 @@ func (f *mockFile) Download(_ context.Context) (io.ReadCloser, error) {
 	return io.NopCloser(bytes.NewReader(f.content)), nil
 }
 
+func (f *mockFile) DownloadHead(ctx context.Context) (io.ReadCloser, string, error) {
+	if f.driveRevision != "" {
+		f.headRevision = f.driveRevision
+	}
+	r, err := f.Download(ctx)
+	return r, f.headRevision, err
+}
+
+func (f *mockFile) DownloadRange(_ context.Context, off, length int64) ([]byte, error) {
+	end := off + length
+	if end > int64(len(f.content)) {
+		end = int64(len(f.content))
+	}
+	return f.content[off:end], nil
+}
+
+func (f *mockFile) NewChild(name string) (driveapi.File, error) {
+	c := &mockFile{name: name, parentID: f.id, parentName: f.name}
+	f.files = append(f.files, c)
+	return c, nil
+}
+
+func (f *mockFile) Upload(_ context.Context, _ *driveapi.Uploader, localPath, baseRevision string) (string, error) {
+	b, err := os.ReadFile(localPath)
+	if err != nil {
+		return "", err
+	}
+	if f.id == "" {
+		f.id = "uploaded-" + f.name
+	}
+	f.content = b
+	f.size = uint64(len(b))
+	f.bases = append(f.bases, baseRevision)
+	f.headRevision = fmt.Sprintf("r%d", len(f.bases)+1)
+	f.driveRevision = ""
+	return f.headRevision, nil
+}
+
+func (f *mockFile) Description() string {
+	return f.description
+}
+
+func (f *mockFile) Properties(scope int) map[string]string {
+	if scope == driveapi.PropertyScopePrivate {
+		return f.appProperties
+	}
+	return f.properties
+}
+
+func (f *mockFile) SetDescription(_ context.Context, desc string) error {
+	f.description = desc
+	return nil
+}
+
+func (f *mockFile) SetProperty(_ context.Context, scope int, key, value string) error {
+	props := &f.properties
+	if scope == driveapi.PropertyScopePrivate {
+		props = &f.appProperties
+	}
+	if *props == nil {
+		*props = map[string]string{}
+	}
+	(*props)[key] = value
+	return nil
+}
+
+func (f *mockFile) RemoveProperty(_ context.Context, scope int, key string) error {
+	props := f.Properties(scope)
+	if _, ok := props[key]; !ok {
+		return driveapi.ErrNoProperty
+	}
+	delete(props, key)
+	return nil
+}
+
+func (f *mockFile) Revisions(_ context.Context) ([]driveapi.File, error) {
+	return f.revisions, nil
+}
+
+func (f *mockFile) Invalidate() {}
+
 var root = &mockFile{
 	name:             "My Drive",
 	mimeType:         driveapi.GoogleAppsMimeTypeText(driveapi.MimeTypeGoogleDriveFolder),
@@ -147,6 +275,68 @@ func TestFS_Root(t *testing.T) {
 	}
 }
 
+func TestFS_RootResolvedOnce(t *testing.T) {
+	var gets int
+	svc := newTestDriveService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/files/root" {
+			http.NotFound(w, r)
+			return
+		}
+		gets++
+		fmt.Fprint(w, `{"id": "rootid", "name": "My Drive",
+			"mimeType": "application/vnd.google-apps.folder"}`)
+	}))
+	f := &FS{Ctx: context.TODO(), DriveSvc: svc}
+	for i := 0; i < 2; i++ {
+		node, err := f.Root()
+		if err != nil {
+			t.Fatalf("FS.Root() error = %v", err)
+		}
+		if id := node.(*Dir).ID(); id != "rootid" {
+			t.Errorf("FS.Root() ID = %q, want rootid", id)
+		}
+	}
+	if gets != 1 {
+		t.Errorf("FS.Root() twice fetched the root %d times, want 1", gets)
+	}
+}
+
+// newTestDriveService returns a Drive client that sends all API calls to
+// the given handler.
+func newTestDriveService(t *testing.T, h http.Handler) *drive.Service {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	svc, err := drive.NewService(context.TODO(),
+		option.WithHTTPClient(srv.Client()), option.WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatalf("drive.NewService() error = %v", err)
+	}
+	return svc
+}
+
+func TestFS_Statfs(t *testing.T) {
+	calls := 0
+	svc := newTestDriveService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"storageQuota": {"limit": "16384000", "usage": "4096000"}}`)
+	}))
+	f := &FS{Ctx: context.TODO(), DriveSvc: svc}
+	for i := 0; i < 2; i++ {
+		resp := &fuse.StatfsResponse{}
+		if err := f.Statfs(context.TODO(), &fuse.StatfsRequest{}, resp); err != nil {
+			t.Fatalf("FS.Statfs() error = %v", err)
+		}
+		if resp.Blocks != 4000 || resp.Bfree != 3000 || resp.Bavail != 3000 {
+			t.Errorf("FS.Statfs() blocks/bfree/bavail = %d/%d/%d, want 4000/3000/3000",
+				resp.Blocks, resp.Bfree, resp.Bavail)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("FS.Statfs() made %d API calls, want 1", calls)
+	}
+}
+
 func TestDir_Attr(t *testing.T) {
 	type fields struct {
 		File driveapi.File
@@ -177,6 +367,7 @@ func TestDir_Attr(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			d := &Dir{
 				File: tt.fields.File,
+				fs:   &FS{},
 			}
 			if err := d.Attr(tt.args.in0, tt.args.attr); (err != nil) != tt.wantErr {
 				t.Errorf("Dir.Attr() error = %v, wantErr %v", err, tt.wantErr)
@@ -267,7 +458,7 @@ func TestDir_Lookup(t *testing.T) {
 				},
 			},
 			want: &File{
-				fileA,
+				file: fileA,
 			},
 		},
 		{
@@ -282,7 +473,7 @@ func TestDir_Lookup(t *testing.T) {
 				},
 			},
 			want: &Dir{
-				dirB,
+				File: dirB,
 			},
 		},
 		{
@@ -347,6 +538,7 @@ func TestFile_Attr(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			f := File{
 				file: tt.fields.file,
+				fs:   &FS{},
 			}
 			if err := f.Attr(tt.args.in0, tt.args.attr); (err != nil) != tt.wantErr {
 				t.Errorf("File.Attr() error = %v, wantErr %v", err, tt.wantErr)
@@ -372,7 +564,7 @@ func TestFile_Open(t *testing.T) {
 		name    string
 		fields  fields
 		args    args
-		want    fs.Handle
+		want    []byte
 		wantErr bool
 	}{
 		{name: "File_Open",
@@ -384,9 +576,7 @@ func TestFile_Open(t *testing.T) {
 				req:  &fuse.OpenRequest{},
 				resp: &fuse.OpenResponse{},
 			},
-			want: &FileHandle{
-				io.NopCloser(bytes.NewReader(fileA.Content())),
-			},
+			want:    fileA.Content(),
 			wantErr: false,
 		},
 	}
@@ -394,14 +584,24 @@ func TestFile_Open(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			f := &File{
 				file: tt.fields.file,
+				fs:   &FS{},
 			}
 			got, err := f.Open(tt.args.ctx, tt.args.req, tt.args.resp)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("File.Open() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("File.Open() = %v, want %v", got, tt.want)
+			fh, ok := got.(*FileHandle)
+			if !ok {
+				t.Fatalf("File.Open() = %T, want *FileHandle", got)
+			}
+			defer fh.Release(context.TODO(), &fuse.ReleaseRequest{})
+			resp := &fuse.ReadResponse{}
+			if err := fh.Read(context.TODO(), &fuse.ReadRequest{Size: 1024}, resp); err != nil {
+				t.Fatalf("FileHandle.Read() error = %v", err)
+			}
+			if !bytes.Equal(resp.Data, tt.want) {
+				t.Errorf("File.Open() handle reads %q, want %q", resp.Data, tt.want)
 			}
 		})
 	}
@@ -409,7 +609,7 @@ func TestFile_Open(t *testing.T) {
 
 func TestFileHandle_Read(t *testing.T) {
 	type fields struct {
-		r io.ReadCloser
+		r *blockReader
 	}
 	type args struct {
 		ctx  context.Context
@@ -425,7 +625,7 @@ func TestFileHandle_Read(t *testing.T) {
 		{
 			name: "FileHandle_Read",
 			fields: fields{
-				r: io.NopCloser(bytes.NewReader(fileA.Content())),
+				r: newBlockReader(context.TODO(), fileA, nil),
 			},
 			args: args{
 				ctx: context.TODO(),
@@ -453,3 +653,759 @@ func TestFileHandle_Read(t *testing.T) {
 		})
 	}
 }
+
+func TestFile_Xattr(t *testing.T) {
+	f := &File{
+		file: &mockFile{
+			name:        "file-x",
+			mimeType:    "text/plain",
+			id:          "fid4",
+			description: "a dataset",
+		},
+	}
+	ctx := context.TODO()
+	get := func(name string) (string, error) {
+		resp := &fuse.GetxattrResponse{}
+		err := f.Getxattr(ctx, &fuse.GetxattrRequest{Name: name}, resp)
+		return string(resp.Xattr), err
+	}
+
+	if got, err := get(xattrID); err != nil || got != "fid4" {
+		t.Errorf("Getxattr(%s) = %q, %v, want %q", xattrID, got, err, "fid4")
+	}
+	if got, err := get(xattrDescription); err != nil || got != "a dataset" {
+		t.Errorf("Getxattr(%s) = %q, %v, want %q", xattrDescription, got, err, "a dataset")
+	}
+	if err := f.Setxattr(ctx, &fuse.SetxattrRequest{Name: xattrID, Xattr: []byte("x")}); err != fuse.EPERM {
+		t.Errorf("Setxattr(%s) error = %v, want EPERM", xattrID, err)
+	}
+
+	name := xattrPropertiesPrefix + "owner"
+	if _, err := get(name); err != fuse.ErrNoXattr {
+		t.Errorf("Getxattr(%s) error = %v, want ErrNoXattr", name, err)
+	}
+	if err := f.Setxattr(ctx, &fuse.SetxattrRequest{Name: name, Xattr: []byte("ml-team")}); err != nil {
+		t.Fatalf("Setxattr(%s) error = %v", name, err)
+	}
+	if got, err := get(name); err != nil || got != "ml-team" {
+		t.Errorf("Getxattr(%s) = %q, %v, want %q", name, got, err, "ml-team")
+	}
+	if err := f.Setxattr(ctx, &fuse.SetxattrRequest{Name: name, Flags: xattrCreate}); err == nil {
+		t.Errorf("Setxattr(%s, XATTR_CREATE) on existing xattr succeeded", name)
+	}
+
+	resp := &fuse.ListxattrResponse{}
+	if err := f.Listxattr(ctx, &fuse.ListxattrRequest{}, resp); err != nil {
+		t.Fatalf("Listxattr() error = %v", err)
+	}
+	want := xattrID + "\x00" + xattrMimeType + "\x00" + xattrDescription + "\x00" + name + "\x00"
+	if string(resp.Xattr) != want {
+		t.Errorf("Listxattr() = %q, want %q", resp.Xattr, want)
+	}
+
+	if err := f.Removexattr(ctx, &fuse.RemovexattrRequest{Name: name}); err != nil {
+		t.Errorf("Removexattr(%s) error = %v", name, err)
+	}
+	if err := f.Removexattr(ctx, &fuse.RemovexattrRequest{Name: name}); err != fuse.ErrNoXattr {
+		t.Errorf("Removexattr(%s) on missing xattr error = %v, want ErrNoXattr", name, err)
+	}
+}
+
+// countingFile counts the ranged downloads made for a mockFile.
+type countingFile struct {
+	*mockFile
+	mu     sync.Mutex
+	ranges map[int64]int
+}
+
+func (f *countingFile) DownloadRange(ctx context.Context, off, length int64) ([]byte, error) {
+	f.mu.Lock()
+	f.ranges[off]++
+	f.mu.Unlock()
+	return f.mockFile.DownloadRange(ctx, off, length)
+}
+
+func TestBlockReader_Readahead(t *testing.T) {
+	content := make([]byte, 10*blockSize+100)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	f := &countingFile{
+		mockFile: &mockFile{name: "big", size: uint64(len(content)), content: content},
+		ranges:   map[int64]int{},
+	}
+	r := newBlockReader(context.TODO(), f, nil)
+	defer r.Close()
+
+	var got []byte
+	buf := make([]byte, 128*1024)
+	for off := int64(0); ; {
+		n, err := r.ReadAt(context.TODO(), buf, off)
+		got = append(got, buf[:n]...)
+		off += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadAt(%d) error = %v", off, err)
+		}
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("sequential ReadAt() returned %d bytes, content mismatch", len(got))
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.ranges) != 11 {
+		t.Errorf("downloaded %d blocks, want 11", len(f.ranges))
+	}
+	for off, n := range f.ranges {
+		if n != 1 {
+			t.Errorf("block at %d downloaded %d times, want 1", off, n)
+		}
+	}
+	if r.window != maxReadahead {
+		t.Errorf("readahead window = %d, want %d", r.window, maxReadahead)
+	}
+}
+
+func TestBlockReader_Cache(t *testing.T) {
+	f := &countingFile{
+		mockFile: &mockFile{id: "fid5", size: uint64(len(fileAContent)), content: fileAContent},
+		ranges:   map[int64]int{},
+	}
+	c := cache.New(blockSize)
+	for i := 0; i < 2; i++ {
+		r := newBlockReader(context.TODO(), f, c)
+		buf := make([]byte, len(fileAContent))
+		if n, err := r.ReadAt(context.TODO(), buf, 0); err != nil || !bytes.Equal(buf[:n], fileAContent) {
+			t.Fatalf("ReadAt() = %q, %v, want %q", buf[:n], err, fileAContent)
+		}
+		r.Close()
+	}
+	if f.ranges[0] != 1 {
+		t.Errorf("block downloaded %d times, want 1", f.ranges[0])
+	}
+	if s := c.Stats(); s.Hits != 1 || s.Misses != 1 {
+		t.Errorf("cache Stats() = %+v, want 1 hit and 1 miss", s)
+	}
+}
+
+func TestFileHandle_ReadChecksum(t *testing.T) {
+	tests := []struct {
+		name    string
+		md5     string
+		wantErr error
+	}{
+		{
+			name: "matching checksum",
+			md5:  fmt.Sprintf("%x", md5.Sum(fileAContent)),
+		},
+		{
+			name:    "corrupt content",
+			md5:     fmt.Sprintf("%x", md5.Sum([]byte("other contents"))),
+			wantErr: fuse.EIO,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &mockFile{
+				id:          "fid6",
+				size:        uint64(len(fileAContent)),
+				content:     fileAContent,
+				md5Checksum: tt.md5,
+			}
+			c := cache.New(blockSize)
+			fh := &FileHandle{r: newBlockReader(context.TODO(), f, c)}
+			defer fh.Release(context.TODO(), &fuse.ReleaseRequest{})
+			resp := &fuse.ReadResponse{}
+			err := fh.Read(context.TODO(), &fuse.ReadRequest{Size: 1024}, resp)
+			if err != tt.wantErr {
+				t.Errorf("FileHandle.Read() error = %v, want %v", err, tt.wantErr)
+			}
+			if s := c.Stats(); tt.wantErr != nil && s.Blocks != 0 {
+				t.Errorf("corrupt blocks left in cache: %+v", s)
+			}
+		})
+	}
+}
+
+func TestDir_CreateWrite(t *testing.T) {
+	dir := &mockFile{name: "dir-c", id: "did7", isDir: true}
+	fsys := &FS{Uploader: &driveapi.Uploader{}, StageDir: t.TempDir()}
+	d := &Dir{File: dir, fs: fsys}
+	ctx := context.TODO()
+
+	node, h, err := d.Create(ctx, &fuse.CreateRequest{Name: "new.txt"}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Dir.Create() error = %v", err)
+	}
+	wh := h.(*WriteHandle)
+	for _, data := range []string{"hello ", "world"} {
+		size, _ := wh.sf.size()
+		resp := &fuse.WriteResponse{}
+		if err := wh.Write(ctx, &fuse.WriteRequest{Data: []byte(data), Offset: size}, resp); err != nil {
+			t.Fatalf("WriteHandle.Write() error = %v", err)
+		}
+	}
+	attr := &fuse.Attr{}
+	if err := node.Attr(ctx, attr); err != nil || attr.Size != 11 || attr.Mode != 0600 {
+		t.Errorf("File.Attr() while open = %+v, %v, want size 11 and mode 0600", attr, err)
+	}
+	if err := wh.Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+		t.Fatalf("WriteHandle.Release() error = %v", err)
+	}
+
+	child := dir.files[0].(*mockFile)
+	if string(child.content) != "hello world" || child.id != "uploaded-new.txt" {
+		t.Errorf("uploaded file = %q (id %q), want %q", child.content, child.id, "hello world")
+	}
+	if entries, _ := os.ReadDir(fsys.StageDir); len(entries) != 0 {
+		t.Errorf("local copies left in stage dir: %v", entries)
+	}
+}
+
+func TestDir_CreateExistingUnlisted(t *testing.T) {
+	for _, viaCreate := range []bool{false, true} {
+		existing := &mockFile{name: "existing.txt", id: "fid-existing", size: 3, content: []byte("old")}
+		dir := &mockFile{name: "dir-u", id: "did-u", isDir: true, unlisted: true,
+			files: []driveapi.File{existing}}
+		fsys := &FS{Uploader: &driveapi.Uploader{}, StageDir: t.TempDir()}
+		d := &Dir{File: dir, fs: fsys}
+		ctx := context.TODO()
+
+		// As for `echo new > dir/existing.txt` without reading dir first.
+		var h fs.Handle
+		if viaCreate {
+			// The kernel may still ask to create a file it does not know of.
+			req := &fuse.CreateRequest{Name: "existing.txt", Flags: fuse.OpenWriteOnly | fuse.OpenCreate | fuse.OpenTruncate}
+			_, ch, err := d.Create(ctx, req, &fuse.CreateResponse{})
+			if err != nil {
+				t.Fatalf("Dir.Create() of an existing file error = %v", err)
+			}
+			h = ch
+		} else {
+			node, err := d.Lookup(ctx, &fuse.LookupRequest{Name: "existing.txt"}, nil)
+			if err != nil {
+				t.Fatalf("Dir.Lookup() in an unlisted dir error = %v", err)
+			}
+			req := &fuse.OpenRequest{Flags: fuse.OpenWriteOnly | fuse.OpenTruncate}
+			if h, err = node.(*File).Open(ctx, req, &fuse.OpenResponse{}); err != nil {
+				t.Fatalf("File.Open() error = %v", err)
+			}
+		}
+		wh := h.(*WriteHandle)
+		if err := wh.Write(ctx, &fuse.WriteRequest{Data: []byte("new")}, &fuse.WriteResponse{}); err != nil {
+			t.Fatalf("WriteHandle.Write() error = %v", err)
+		}
+		if err := wh.Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+			t.Fatalf("WriteHandle.Release() error = %v", err)
+		}
+		if len(dir.files) != 1 || string(existing.content) != "new" {
+			t.Errorf("create via Create=%v: dir has %d files, existing file = %q, want it overwritten with %q",
+				viaCreate, len(dir.files), existing.content, "new")
+		}
+	}
+	dir := &mockFile{name: "dir-v", id: "did-v", isDir: true, unlisted: true,
+		files: []driveapi.File{&mockFile{name: "existing.txt", id: "fid-v"}}}
+	d := &Dir{File: dir, fs: &FS{Uploader: &driveapi.Uploader{}, StageDir: t.TempDir()}}
+	req := &fuse.CreateRequest{Name: "existing.txt", Flags: fuse.OpenWriteOnly | fuse.OpenCreate | fuse.OpenExclusive}
+	if _, _, err := d.Create(context.TODO(), req, &fuse.CreateResponse{}); err != fuse.Errno(syscall.EEXIST) {
+		t.Errorf("Dir.Create(O_EXCL) of an existing file error = %v, want EEXIST", err)
+	}
+}
+
+func TestFile_OpenReadOnlyMount(t *testing.T) {
+	f := &File{file: fileA, fs: &FS{}}
+	req := &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}
+	if _, err := f.Open(context.TODO(), req, &fuse.OpenResponse{}); err != errReadOnly {
+		t.Errorf("File.Open(O_WRONLY) on read-only mount error = %v, want EROFS", err)
+	}
+}
+
+func TestFile_ReadQueued(t *testing.T) {
+	dir := &mockFile{name: "dir-d", id: "did8", isDir: true}
+	q, err := writeback.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := &FS{Uploader: &driveapi.Uploader{}, StageDir: t.TempDir(), Queue: q}
+	d := &Dir{File: dir, fs: fsys}
+	ctx := context.TODO()
+
+	node, h, err := d.Create(ctx, &fuse.CreateRequest{Name: "queued.txt"}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Dir.Create() error = %v", err)
+	}
+	wh := h.(*WriteHandle)
+	if err := wh.Write(ctx, &fuse.WriteRequest{Data: []byte("staged")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatalf("WriteHandle.Write() error = %v", err)
+	}
+	if err := wh.Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+		t.Fatalf("WriteHandle.Release() error = %v", err)
+	}
+	if q.Len() != 1 {
+		t.Fatalf("queue has %d pending uploads, want 1", q.Len())
+	}
+
+	f := node.(*File)
+	rh, err := f.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatalf("File.Open() error = %v", err)
+	}
+	defer rh.(fs.HandleReleaser).Release(ctx, &fuse.ReleaseRequest{})
+	resp := &fuse.ReadResponse{}
+	if err := rh.(fs.HandleReader).Read(ctx, &fuse.ReadRequest{Size: 100}, resp); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if string(resp.Data) != "staged" {
+		t.Errorf("Read() of queued file = %q, want %q", resp.Data, "staged")
+	}
+	attr := &fuse.Attr{}
+	if err := f.Attr(ctx, attr); err != nil || attr.Size != 6 {
+		t.Errorf("File.Attr() of queued file size = %d, %v, want 6", attr.Size, err)
+	}
+}
+
+func TestFile_Fsync(t *testing.T) {
+	dir := &mockFile{name: "dir-e", id: "did9", isDir: true}
+	q, err := writeback.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	q.Start(ctx, 1)
+	fsys := &FS{Uploader: &driveapi.Uploader{}, StageDir: t.TempDir(), Queue: q}
+	d := &Dir{File: dir, fs: fsys}
+
+	node, h, err := d.Create(ctx, &fuse.CreateRequest{Name: "synced.txt"}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Dir.Create() error = %v", err)
+	}
+	wh := h.(*WriteHandle)
+	if err := wh.Write(ctx, &fuse.WriteRequest{Data: []byte("durable")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatalf("WriteHandle.Write() error = %v", err)
+	}
+	if err := node.(*File).Fsync(ctx, &fuse.FsyncRequest{}); err != nil {
+		t.Fatalf("File.Fsync() error = %v", err)
+	}
+	child := dir.files[0].(*mockFile)
+	if string(child.content) != "durable" || q.Len() != 0 {
+		t.Errorf("after Fsync() uploaded %q with %d pending uploads, want %q and none",
+			child.content, q.Len(), "durable")
+	}
+	// Nothing was written since, so closing does not upload again.
+	child.content = nil
+	if err := wh.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+		t.Fatalf("WriteHandle.Flush() error = %v", err)
+	}
+	if err := wh.Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+		t.Fatalf("WriteHandle.Release() error = %v", err)
+	}
+	if q.Len() != 0 || child.content != nil {
+		t.Errorf("Release() after Fsync() queued %d uploads", q.Len())
+	}
+	if entries, _ := os.ReadDir(fsys.StageDir); len(entries) != 0 {
+		t.Errorf("local copies left in stage dir: %v", entries)
+	}
+}
+
+func TestFile_WriteBaseRevision(t *testing.T) {
+	// The file changed on Drive since it was listed.
+	file := &mockFile{name: "base.txt", id: "fid-base", size: 3, content: []byte("old"),
+		headRevision: "r1", driveRevision: "r5"}
+	q, err := writeback.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	q.Start(ctx, 1)
+	fsys := &FS{Uploader: &driveapi.Uploader{}, StageDir: t.TempDir(), Queue: q}
+	f := &File{file: file, fs: fsys}
+
+	h, err := f.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadWrite}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatalf("File.Open() error = %v", err)
+	}
+	wh := h.(*WriteHandle)
+	for _, data := range []string{"new", "newer"} {
+		if err := wh.Write(ctx, &fuse.WriteRequest{Data: []byte(data)}, &fuse.WriteResponse{}); err != nil {
+			t.Fatalf("WriteHandle.Write() error = %v", err)
+		}
+		if err := f.Fsync(ctx, &fuse.FsyncRequest{}); err != nil {
+			t.Fatalf("File.Fsync() error = %v", err)
+		}
+	}
+	wh.Release(ctx, &fuse.ReleaseRequest{})
+	// The first upload is based on the revision that was downloaded, and
+	// the next one on the revision the first one made.
+	if want := []string{"r5", "r2"}; !reflect.DeepEqual(file.bases, want) {
+		t.Errorf("uploads based on %q, want %q", file.bases, want)
+	}
+}
+
+func TestWriteHandle_FlushSyncOnClose(t *testing.T) {
+	dir := &mockFile{name: "dir-f", id: "did10", isDir: true}
+	fsys := &FS{Uploader: &driveapi.Uploader{}, StageDir: t.TempDir(), SyncOnClose: true}
+	d := &Dir{File: dir, fs: fsys}
+	ctx := context.TODO()
+
+	_, h, err := d.Create(ctx, &fuse.CreateRequest{Name: "closed.txt"}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Dir.Create() error = %v", err)
+	}
+	wh := h.(*WriteHandle)
+	if err := wh.Write(ctx, &fuse.WriteRequest{Data: []byte("on close")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatalf("WriteHandle.Write() error = %v", err)
+	}
+	if err := wh.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+		t.Fatalf("WriteHandle.Flush() error = %v", err)
+	}
+	child := dir.files[0].(*mockFile)
+	if string(child.content) != "on close" {
+		t.Errorf("uploaded on Flush() = %q, want %q", child.content, "on close")
+	}
+	wh.Release(ctx, &fuse.ReleaseRequest{})
+}
+
+func TestDir_LookupRevisions(t *testing.T) {
+	old := &mockFile{name: "2021-03-04T05:06:07Z.txt", id: "fid11", content: []byte("old"), size: 3}
+	f := &mockFile{name: "notes.txt", id: "fid11", revisions: []driveapi.File{old}}
+	d := &Dir{File: &mockFile{name: "dir-g", isDir: true, files: []driveapi.File{f}}, fs: &FS{}}
+	ctx := context.TODO()
+	attr := &fuse.Attr{}
+
+	entries, err := d.ReadDirAll(ctx)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("Dir.ReadDirAll() = %v, %v, want only the file itself", entries, err)
+	}
+	if _, err := d.Lookup(ctx, &fuse.LookupRequest{Name: "other.txt@revisions"}, nil); err != fuse.ENOENT {
+		t.Errorf("Dir.Lookup() of revisions of a missing file error = %v, want ENOENT", err)
+	}
+	node, err := d.Lookup(ctx, &fuse.LookupRequest{Name: "notes.txt@revisions"}, nil)
+	if err != nil {
+		t.Fatalf("Dir.Lookup() error = %v", err)
+	}
+	rd := node.(*RevisionsDir)
+	if err := rd.Attr(ctx, attr); err != nil || attr.Mode != os.ModeDir|0500 {
+		t.Errorf("RevisionsDir.Attr() = %+v, %v, want a read-only dir", attr, err)
+	}
+	entries, err = rd.ReadDirAll(ctx)
+	if err != nil || len(entries) != 1 || entries[0].Name != old.name {
+		t.Fatalf("RevisionsDir.ReadDirAll() = %v, %v, want %q", entries, err, old.name)
+	}
+	node, err = rd.Lookup(ctx, &fuse.LookupRequest{Name: old.name}, nil)
+	if err != nil {
+		t.Fatalf("RevisionsDir.Lookup() error = %v", err)
+	}
+	rf := node.(*RevisionFile)
+	attr = &fuse.Attr{}
+	if err := rf.Attr(ctx, attr); err != nil || attr.Mode != 0400 || attr.Size != 3 {
+		t.Errorf("RevisionFile.Attr() = %+v, %v, want mode 0400 and size 3", attr, err)
+	}
+	if _, err := rf.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{}); err != errReadOnly {
+		t.Errorf("RevisionFile.Open(O_WRONLY) error = %v, want EROFS", err)
+	}
+	h, err := rf.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatalf("RevisionFile.Open() error = %v", err)
+	}
+	defer h.(fs.HandleReleaser).Release(ctx, &fuse.ReleaseRequest{})
+	resp := &fuse.ReadResponse{}
+	if err := h.(fs.HandleReader).Read(ctx, &fuse.ReadRequest{Size: 100}, resp); err != nil || string(resp.Data) != "old" {
+		t.Errorf("Read() of revision = %q, %v, want %q", resp.Data, err, "old")
+	}
+}
+
+// invalidatingFile records calls to Invalidate.
+type invalidatingFile struct {
+	*mockFile
+	invalidated int
+}
+
+func (f *invalidatingFile) Invalidate() { f.invalidated++ }
+
+func TestControlDir(t *testing.T) {
+	sub := &invalidatingFile{mockFile: &mockFile{name: "sub", id: "did12", isDir: true}}
+	top := &mockFile{name: "My Drive", id: "root", isDir: true, files: []driveapi.File{sub}}
+	fsys := &FS{
+		Cache:   cache.New(1 << 20),
+		Config:  map[string]string{"readwrite": "false", "cachesize": "1"},
+		started: time.Now(),
+		root:    top,
+	}
+	d := &Dir{File: top, fs: fsys}
+	ctx := context.TODO()
+
+	entries, err := d.ReadDirAll(ctx)
+	if err != nil || len(entries) != 2 || entries[0].Name != ".drivefs" {
+		t.Fatalf("root Dir.ReadDirAll() = %v, %v, want .drivefs listed", entries, err)
+	}
+	node, err := d.Lookup(ctx, &fuse.LookupRequest{Name: ".drivefs"}, nil)
+	if err != nil {
+		t.Fatalf("Dir.Lookup(.drivefs) error = %v", err)
+	}
+	cd := node.(*ControlDir)
+	if _, err := (&Dir{File: sub, fs: fsys}).Lookup(ctx, &fuse.LookupRequest{Name: ".drivefs"}, nil); err != fuse.ENOENT {
+		t.Errorf("Dir.Lookup(.drivefs) below the root error = %v, want ENOENT", err)
+	}
+
+	read := func(name string) string {
+		node, err := cd.Lookup(ctx, &fuse.LookupRequest{Name: name}, nil)
+		if err != nil {
+			t.Fatalf("ControlDir.Lookup(%s) error = %v", name, err)
+		}
+		attr := &fuse.Attr{}
+		if err := node.Attr(ctx, attr); err != nil || attr.Size != 0 {
+			t.Errorf("ControlFile.Attr(%s) size = %d, %v, want 0", name, attr.Size, err)
+		}
+		oresp := &fuse.OpenResponse{}
+		h, err := node.(*ControlFile).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, oresp)
+		if err != nil {
+			t.Fatalf("ControlFile.Open(%s) error = %v", name, err)
+		}
+		if oresp.Flags&fuse.OpenDirectIO == 0 {
+			t.Errorf("ControlFile.Open(%s) flags = %v, want direct I/O", name, oresp.Flags)
+		}
+		resp := &fuse.ReadResponse{}
+		if err := h.(fs.HandleReader).Read(ctx, &fuse.ReadRequest{Size: 4096}, resp); err != nil {
+			t.Fatalf("ControlHandle.Read(%s) error = %v", name, err)
+		}
+		return string(resp.Data)
+	}
+	write := func(name, data string) error {
+		node, _ := cd.Lookup(ctx, &fuse.LookupRequest{Name: name}, nil)
+		h, err := node.(*ControlFile).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+		if err != nil {
+			t.Fatalf("ControlFile.Open(%s) error = %v", name, err)
+		}
+		return h.(fs.HandleWriter).Write(ctx, &fuse.WriteRequest{Data: []byte(data)}, &fuse.WriteResponse{})
+	}
+
+	if got := read("status"); !strings.Contains(got, "uptime: ") || !strings.Contains(got, "cache: 0 blocks") {
+		t.Errorf("status = %q, want uptime and cache usage", got)
+	}
+	if got, want := read("config"), "cachesize = 1\nreadwrite = false\n"; got != want {
+		t.Errorf("config = %q, want %q", got, want)
+	}
+	if err := write("refresh", "/sub\n"); err != nil || sub.invalidated != 1 {
+		t.Errorf("writing refresh = %v, invalidated %d times, want 1", err, sub.invalidated)
+	}
+	if err := write("invalidate", "missing"); err != fuse.ENOENT {
+		t.Errorf("writing invalidate of a missing path error = %v, want ENOENT", err)
+	}
+	if got := read("errors"); !strings.Contains(got, "invalidate missing: no such file or directory") {
+		t.Errorf("errors = %q, want the failed invalidate", got)
+	}
+	if _, err := cd.Lookup(ctx, &fuse.LookupRequest{Name: "other"}, nil); err != fuse.ENOENT {
+		t.Errorf("ControlDir.Lookup(other) error = %v, want ENOENT", err)
+	}
+}
+
+// revokedFile fails to list as when Drive no longer accepts the
+// credentials.
+type revokedFile struct {
+	*mockFile
+}
+
+func (f *revokedFile) ListFiles(context.Context) ([]driveapi.File, error) {
+	return nil, fmt.Errorf("listing: %w", driveapi.ErrAuthRevoked)
+}
+
+func TestDir_ReadDirAllAuthRevoked(t *testing.T) {
+	fsys := &FS{}
+	d := &Dir{File: &revokedFile{&mockFile{name: "dir", id: "did1", isDir: true}}, fs: fsys}
+	if _, err := d.ReadDirAll(context.TODO()); err != fuse.Errno(syscall.EACCES) {
+		t.Errorf("Dir.ReadDirAll() error = %v, want EACCES", err)
+	}
+	if got := fsys.errs.snapshot(); len(got) != 1 || !errors.Is(got[0].err, driveapi.ErrAuthRevoked) {
+		t.Errorf("recorded errors = %v, want the revoked authorization", got)
+	}
+}
+
+func TestFS_Perms(t *testing.T) {
+	dir := &mockFile{name: "dir", id: "did1", isDir: true}
+	file := &mockFile{name: "a.txt", id: "fid1", size: 3}
+	fsys := &FS{Perms: &Perms{Uid: 1000, Gid: 100, Umask: 0022}}
+	ctx := context.TODO()
+
+	for _, tt := range []struct {
+		name     string
+		uploader *driveapi.Uploader
+		node     fs.Node
+		want     os.FileMode
+	}{
+		{"read-only dir", nil, &Dir{File: dir, fs: fsys}, os.ModeDir | 0555},
+		{"read-only file", nil, &File{file: file, fs: fsys}, 0444},
+		{"writable dir", &driveapi.Uploader{}, &Dir{File: dir, fs: fsys}, os.ModeDir | 0755},
+		{"writable file", &driveapi.Uploader{}, &File{file: file, fs: fsys}, 0644},
+		{"control dir", nil, &ControlDir{fs: fsys}, os.ModeDir | 0500},
+	} {
+		fsys.Uploader = tt.uploader
+		attr := &fuse.Attr{}
+		if err := tt.node.Attr(ctx, attr); err != nil {
+			t.Fatalf("%s: Attr() error = %v", tt.name, err)
+		}
+		if attr.Mode != tt.want || attr.Uid != 1000 || attr.Gid != 100 {
+			t.Errorf("%s: mode %v, owner %d:%d, want %v, 1000:100", tt.name, attr.Mode, attr.Uid, attr.Gid, tt.want)
+		}
+	}
+}
+
+// metricValue returns the value of an unlabeled metric in the Default
+// registry.
+func metricValue(t *testing.T, name string) float64 {
+	var b strings.Builder
+	metrics.Default.WriteText(&b)
+	for _, line := range strings.Split(b.String(), "\n") {
+		if v := strings.TrimPrefix(line, name+" "); v != line {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return f
+		}
+	}
+	t.Fatalf("metric %s not found", name)
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	fsys := &FS{Cache: cache.New(1 << 20)}
+	fsys.RegisterMetrics(metrics.Default)
+	f := &File{file: fileA, fs: fsys}
+	ctx := context.TODO()
+	handles := metricValue(t, "drivefs_open_handles")
+
+	h, err := f.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatalf("File.Open() error = %v", err)
+	}
+	if err := h.(fs.HandleReader).Read(ctx, &fuse.ReadRequest{Size: 100}, &fuse.ReadResponse{}); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if got := metricValue(t, "drivefs_open_handles"); got != handles+1 {
+		t.Errorf("drivefs_open_handles = %v while open, want %v", got, handles+1)
+	}
+	if got := metricValue(t, "drivefs_cache_budget_bytes"); got != 1<<20 {
+		t.Errorf("drivefs_cache_budget_bytes = %v, want %v", got, 1<<20)
+	}
+	var b strings.Builder
+	metrics.Default.WriteText(&b)
+	if want := `drivefs_fuse_op_duration_seconds_count{op="read"} `; !strings.Contains(b.String(), want) {
+		t.Errorf("metrics missing %q:\n%s", want, b.String())
+	}
+	h.(fs.HandleReleaser).Release(ctx, &fuse.ReleaseRequest{})
+	if got := metricValue(t, "drivefs_open_handles"); got != handles {
+		t.Errorf("drivefs_open_handles = %v after release, want %v", got, handles)
+	}
+}
+
+// slowFile is a file whose download waits until release is closed.
+type slowFile struct {
+	*mockFile
+	release chan struct{}
+}
+
+func (f *slowFile) DownloadHead(ctx context.Context) (io.ReadCloser, string, error) {
+	<-f.release
+	return f.mockFile.DownloadHead(ctx)
+}
+
+func TestFS_StageConcurrent(t *testing.T) {
+	slow := &slowFile{
+		mockFile: &mockFile{name: "big.bin", id: "fid-big", size: 3, content: []byte("big")},
+		release:  make(chan struct{}),
+	}
+	other := &mockFile{name: "small.txt", id: "fid-small", size: 5, content: []byte("small")}
+	fsys := &FS{Uploader: &driveapi.Uploader{}, StageDir: t.TempDir()}
+	ctx := context.TODO()
+
+	type result struct {
+		sf  *stagedFile
+		err error
+	}
+	results := make(chan result, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			sf, err := fsys.stage(ctx, slow, false)
+			results <- result{sf, err}
+		}()
+	}
+
+	// The download of one file holds up neither the others nor its Attr.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sf, err := fsys.stage(ctx, other, false)
+		if err != nil {
+			t.Errorf("stage() of another file error = %v", err)
+			return
+		}
+		if _, ok := fsys.localSize(slow); ok {
+			t.Errorf("localSize() of a file being filled is known")
+		}
+		fsys.unstage(ctx, sf)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stage() of another file blocked on a download")
+	}
+
+	close(slow.release)
+	r1, r2 := <-results, <-results
+	if r1.err != nil || r2.err != nil {
+		t.Fatalf("stage() errors = %v, %v", r1.err, r2.err)
+	}
+	if r1.sf != r2.sf {
+		t.Errorf("stage() of the same file returned two copies")
+	}
+	if size, ok := fsys.localSize(slow); !ok || size != 3 {
+		t.Errorf("localSize() = %d, %v, want 3", size, ok)
+	}
+	fsys.unstage(ctx, r1.sf)
+	fsys.unstage(ctx, r2.sf)
+	if fsys.isStaged(slow) {
+		t.Errorf("file still staged after the last unstage")
+	}
+}
+
+func TestFS_StageSameFileRelisted(t *testing.T) {
+	fsys := &FS{Uploader: &driveapi.Uploader{}, StageDir: t.TempDir()}
+	ctx := context.TODO()
+	listed := &mockFile{name: "a.txt", id: "fid-a", parentID: "did", size: 3, content: []byte("abc")}
+	// The same file, listed again after the listing TTL expired.
+	relisted := &mockFile{name: "a.txt", id: "fid-a", parentID: "did", size: 3, content: []byte("abc")}
+
+	sf1, err := fsys.stage(ctx, listed, false)
+	if err != nil {
+		t.Fatalf("stage() error = %v", err)
+	}
+	sf2, err := fsys.stage(ctx, relisted, false)
+	if err != nil {
+		t.Fatalf("stage() error = %v", err)
+	}
+	if sf1 != sf2 {
+		t.Errorf("stage() of a relisted file returned a second copy")
+	}
+	fsys.unstage(ctx, sf1)
+	if !fsys.isStaged(relisted) {
+		t.Errorf("isStaged() of a relisted file = false while it is open")
+	}
+	fsys.unstage(ctx, sf2)
+
+	// A new file staged before it had an ID is found once it has one.
+	added := &mockFile{name: "b.txt", parentID: "did"}
+	sf, err := fsys.stage(ctx, added, true)
+	if err != nil {
+		t.Fatalf("stage() error = %v", err)
+	}
+	added.id = "fid-b"
+	if !fsys.isStaged(added) {
+		t.Errorf("isStaged() of a new file after it was created = false")
+	}
+	fsys.unstage(ctx, sf)
+}
@@ -0,0 +1,49 @@
+package fusehooks
+
+import (
+	"time"
+
+	"bazil.org/fuse/fs"
+	"github.com/althk/drivefs/metrics"
+)
+
+var (
+	opDuration = metrics.NewHistogram("drivefs_fuse_op_duration_seconds",
+		"Time taken to serve FUSE operations, by operation.", metrics.DefaultBuckets, "op")
+	opErrors = metrics.NewCounter("drivefs_fuse_op_errors_total",
+		"FUSE operations that returned an error, by operation.", "op")
+	openHandles = metrics.NewGauge("drivefs_open_handles",
+		"File handles currently open.")
+)
+
+// observe records a FUSE operation started at start that returned *err.
+// It is meant to be deferred with the named error result of the operation.
+func observe(op string, start time.Time, err *error) {
+	opDuration.Observe(time.Since(start).Seconds(), op)
+	if *err != nil {
+		opErrors.Inc(op)
+	}
+}
+
+// opened counts h as an open handle until it is released.
+func opened(h fs.Handle) fs.Handle {
+	openHandles.Add(1)
+	return h
+}
+
+// RegisterMetrics registers the metrics of the shared state of the mount,
+// computed when they are collected, in r.
+func (f *FS) RegisterMetrics(r *metrics.Registry) {
+	if f.Cache != nil {
+		r.NewGaugeFunc("drivefs_cache_size_bytes", "Size of the blocks in the content cache.",
+			func() float64 { return float64(f.Cache.Stats().Size) })
+		r.NewGaugeFunc("drivefs_cache_budget_bytes", "Maximum size of the content cache.",
+			func() float64 { return float64(f.Cache.Stats().Budget) })
+		r.NewGaugeFunc("drivefs_cache_hit_ratio", "Fraction of content cache lookups that hit.",
+			func() float64 { return f.Cache.Stats().HitRatio() })
+	}
+	if f.Queue != nil {
+		r.NewGaugeFunc("drivefs_pending_uploads", "Files waiting to be uploaded.",
+			func() float64 { return float64(f.Queue.Len()) })
+	}
+}
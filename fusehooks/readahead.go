@@ -0,0 +1,235 @@
+package fusehooks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/althk/drivefs/cache"
+	"github.com/althk/drivefs/driveapi"
+)
+
+// File contents are read in fixed size blocks using ranged downloads.
+// While a handle is read sequentially, the blocks following each read are
+// prefetched concurrently. The prefetch window starts at minReadahead
+// blocks and doubles on every sequential read up to maxReadahead, and is
+// dropped as soon as the handle is read out of order.
+const (
+	blockSize      = 1 << 20
+	minReadahead   = 2
+	maxReadahead   = 16
+	maxFileFetches = 4
+)
+
+// globalFetches caps the number of block downloads in flight across all
+// open files.
+var globalFetches = make(chan struct{}, 16)
+
+type block struct {
+	done chan struct{} // closed once data or err is set
+	data []byte
+	err  error
+}
+
+// blockReader reads a Drive file through a per-handle set of blocks.
+// Downloaded blocks are also added to the shared cache, if any, so that
+// later handles of the same file version can skip the download. Once a
+// handle has read every block in order, whether downloaded or cached, the
+// content is verified against the file checksum.
+type blockReader struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	file    driveapi.File
+	cache   *cache.BlockCache
+	version string
+	fetches chan struct{}
+
+	mu       sync.Mutex
+	blocks   map[int64]*block
+	next     int64 // block a sequential reader is expected to read next
+	window   int   // number of blocks to prefetch after each read
+	verifier *driveapi.Verifier
+	verified int64 // number of leading blocks fed to verifier
+}
+
+func newBlockReader(ctx context.Context, f driveapi.File, c *cache.BlockCache) *blockReader {
+	ctx, cancel := context.WithCancel(ctx)
+	return &blockReader{
+		ctx:      ctx,
+		cancel:   cancel,
+		file:     f,
+		cache:    c,
+		version:  fmt.Sprintf("%d/%s", f.Version(), f.MD5Checksum()),
+		fetches:  make(chan struct{}, maxFileFetches),
+		blocks:   make(map[int64]*block),
+		verifier: driveapi.NewVerifier(f),
+	}
+}
+
+// ReadAt reads len(p) bytes at offset off, waiting for the blocks that
+// cover the range and scheduling the prefetch of the ones after it.
+func (r *blockReader) ReadAt(ctx context.Context, p []byte, off int64) (int, error) {
+	size := int64(r.file.Size())
+	if off >= size {
+		return 0, io.EOF
+	}
+	if off+int64(len(p)) > size {
+		p = p[:size-off]
+	}
+	first, last := off/blockSize, (off+int64(len(p))-1)/blockSize
+
+	r.mu.Lock()
+	if first == r.next || first == r.next-1 {
+		r.window *= 2
+		if r.window < minReadahead {
+			r.window = minReadahead
+		}
+		if r.window > maxReadahead {
+			r.window = maxReadahead
+		}
+	} else {
+		r.window = 0
+	}
+	r.next = last + 1
+	for i := range r.blocks {
+		if i < first-1 || i > last+maxReadahead {
+			delete(r.blocks, i)
+		}
+	}
+	var blocks []*block
+	for i := first; i <= last; i++ {
+		blocks = append(blocks, r.fetch(i, size, false))
+	}
+	for i := last + 1; i <= last+int64(r.window); i++ {
+		r.fetch(i, size, true)
+	}
+	r.mu.Unlock()
+
+	n := 0
+	for i, b := range blocks {
+		select {
+		case <-b.done:
+		case <-ctx.Done():
+			return n, ctx.Err()
+		}
+		if b.err != nil {
+			return n, b.err
+		}
+		if err := r.verify(first+int64(i), b, size); err != nil {
+			return n, err
+		}
+		start := off + int64(n) - (first+int64(i))*blockSize
+		if start >= int64(len(b.data)) {
+			return n, io.ErrUnexpectedEOF
+		}
+		n += copy(p[n:], b.data[start:])
+	}
+	return n, nil
+}
+
+// fetch returns the block with the given index, starting its download if
+// it is not already cached or in flight. Prefetches do not count as cache
+// hits or misses. Must be called with r.mu held.
+func (r *blockReader) fetch(i, size int64, prefetch bool) *block {
+	if b, ok := r.blocks[i]; ok {
+		return b
+	}
+	off := i * blockSize
+	if off >= size {
+		return nil
+	}
+	length := size - off
+	if length > blockSize {
+		length = blockSize
+	}
+	b := &block{done: make(chan struct{})}
+	r.blocks[i] = b
+	key := cache.Key{FileID: r.file.ID(), Index: i}
+	if r.cache != nil {
+		get := r.cache.Get
+		if prefetch {
+			get = r.cache.Peek
+		}
+		if data, ok := get(key, r.version); ok {
+			b.data = data
+			close(b.done)
+			return b
+		}
+	}
+	go func() {
+		defer close(b.done)
+		if b.err = r.acquire(); b.err == nil {
+			b.data, b.err = r.file.DownloadRange(r.ctx, off, length)
+			r.release()
+		}
+		if b.err == nil && r.cache != nil {
+			r.cache.Put(key, r.version, b.data)
+		}
+		if b.err != nil {
+			// Forget failed blocks so that the next read retries them.
+			r.mu.Lock()
+			if r.blocks[i] == b {
+				delete(r.blocks, i)
+			}
+			r.mu.Unlock()
+		}
+	}()
+	return b
+}
+
+// verify feeds block i to the verifier if it is the next one in order and
+// checks the checksum once all blocks have been fed. On a mismatch, all
+// cached blocks of the file are dropped so that it is downloaded again.
+func (r *blockReader) verify(i int64, b *block, size int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i != r.verified {
+		return nil
+	}
+	r.verifier.Write(b.data)
+	r.verified++
+	if r.verified*blockSize < size {
+		return nil
+	}
+	if err := r.verifier.Verify(); err != nil {
+		if r.cache != nil {
+			r.cache.Invalidate(r.file.ID())
+		}
+		r.blocks = make(map[int64]*block)
+		r.verifier = driveapi.NewVerifier(r.file)
+		r.verified = 0
+		return err
+	}
+	return nil
+}
+
+// acquire waits for a download slot for this file and a global one.
+func (r *blockReader) acquire() error {
+	select {
+	case r.fetches <- struct{}{}:
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+	select {
+	case globalFetches <- struct{}{}:
+		return nil
+	case <-r.ctx.Done():
+		<-r.fetches
+		return r.ctx.Err()
+	}
+}
+
+func (r *blockReader) release() {
+	<-globalFetches
+	<-r.fetches
+}
+
+// Close cancels any in flight downloads and drops the cached blocks.
+func (r *blockReader) Close() error {
+	r.cancel()
+	r.mu.Lock()
+	r.blocks = make(map[int64]*block)
+	r.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,106 @@
+package fusehooks
+
+import (
+	"context"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/althk/drivefs/driveapi"
+)
+
+// The past revisions of a file are found in a hidden directory next to it,
+// named after the file with revisionsSuffix appended. The directory is not
+// listed, but can be looked up, e.g. `ls file.txt@revisions/`.
+const revisionsSuffix = "@revisions"
+
+// revisionsDir returns the revisions directory with the given name, or nil
+// if there is no file among files, the listing of d, it belongs to.
+func (d *Dir) revisionsDir(files []driveapi.File, name string) *RevisionsDir {
+	if !strings.HasSuffix(name, revisionsSuffix) {
+		return nil
+	}
+	name = strings.TrimSuffix(name, revisionsSuffix)
+	for _, f := range files {
+		if f.Name() == name && !f.IsDir() && !f.IsGoogleAppsFile() {
+			return &RevisionsDir{file: f, fs: d.fs}
+		}
+	}
+	return nil
+}
+
+// RevisionsDir lists the past revisions of a file kept by Drive, as
+// read-only files named by the time they were made.
+type RevisionsDir struct {
+	file driveapi.File
+	fs   *FS
+}
+
+var _ fs.Node = (*RevisionsDir)(nil)
+
+func (rd *RevisionsDir) Attr(_ context.Context, attr *fuse.Attr) error {
+	attr.Mode = rd.fs.mode(true, false)
+	rd.fs.own(attr)
+	attr.Mtime = time.Now()
+	attr.Ctime = time.Now()
+	return nil
+}
+
+var _ = fs.HandleReadDirAller(&RevisionsDir{})
+
+func (rd *RevisionsDir) ReadDirAll(ctx context.Context) (_ []fuse.Dirent, err error) {
+	defer observe("readdir", time.Now(), &err)
+	revs, err := rd.file.Revisions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var res []fuse.Dirent
+	for _, r := range revs {
+		res = append(res, fuse.Dirent{Name: r.Name(), Type: fuse.DT_File})
+	}
+	return res, nil
+}
+
+var _ = fs.NodeRequestLookuper(&RevisionsDir{})
+
+func (rd *RevisionsDir) Lookup(
+	ctx context.Context, req *fuse.LookupRequest,
+	_ *fuse.LookupResponse) (_ fs.Node, err error) {
+	defer observe("lookup", time.Now(), &err)
+	revs, err := rd.file.Revisions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range revs {
+		if r.Name() == req.Name {
+			return &RevisionFile{rev: r, fs: rd.fs}, nil
+		}
+	}
+	return nil, fuse.ToErrno(syscall.ENOENT)
+}
+
+// RevisionFile is a read-only past revision of a file. Copying it over the
+// file restores it.
+type RevisionFile struct {
+	rev driveapi.File
+	fs  *FS
+}
+
+var _ fs.Node = (*RevisionFile)(nil)
+
+func (rf *RevisionFile) Attr(_ context.Context, attr *fuse.Attr) error {
+	return rf.fs.mapAttr(rf.rev, attr, false)
+}
+
+var _ = fs.NodeOpener(&RevisionFile{})
+
+func (rf *RevisionFile) Open(_ context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (_ fs.Handle, err error) {
+	defer observe("open", time.Now(), &err)
+	if !req.Flags.IsReadOnly() {
+		return nil, errReadOnly
+	}
+	resp.Flags |= fuse.OpenKeepCache
+	return opened(&FileHandle{r: newBlockReader(context.Background(), rf.rev, rf.fs.Cache), fs: rf.fs}), nil
+}
@@ -0,0 +1,71 @@
+package fusehooks
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/althk/drivefs/driveapi"
+)
+
+const (
+	// statfsBlockSize is the block size the quota is reported in.
+	statfsBlockSize = 4096
+	// quotaRefreshInterval is how long a fetched quota is served from cache.
+	quotaRefreshInterval = 5 * time.Minute
+	// unlimitedQuota is reported as the total size of accounts without a
+	// storage limit, so that free space checks always pass.
+	unlimitedQuota = 1 << 50
+)
+
+// quotaCache holds the last storage quota fetched from Drive.
+type quotaCache struct {
+	mu           sync.Mutex
+	limit, usage uint64
+	fetchTime    time.Time
+}
+
+// get returns the cached quota, refreshing it first if it is stale. If the
+// refresh fails, a previously fetched quota is returned instead.
+func (q *quotaCache) get(ctx context.Context, f *FS) (limit, usage uint64, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if time.Since(q.fetchTime) < quotaRefreshInterval {
+		return q.limit, q.usage, nil
+	}
+	limit, usage, err = driveapi.StorageQuota(ctx, f.DriveSvc)
+	if err != nil {
+		if q.fetchTime.IsZero() {
+			return 0, 0, err
+		}
+		return q.limit, q.usage, nil
+	}
+	q.limit, q.usage, q.fetchTime = limit, usage, time.Now()
+	return limit, usage, nil
+}
+
+var _ fs.FSStatfser = (*FS)(nil)
+
+func (f *FS) Statfs(ctx context.Context, _ *fuse.StatfsRequest, resp *fuse.StatfsResponse) (err error) {
+	defer observe("statfs", time.Now(), &err)
+	limit, usage, err := f.quota.get(ctx, f)
+	if err != nil {
+		return err
+	}
+	if limit == 0 {
+		limit = usage + unlimitedQuota
+	}
+	var free uint64
+	if limit > usage {
+		free = limit - usage
+	}
+	resp.Bsize = statfsBlockSize
+	resp.Frsize = statfsBlockSize
+	resp.Blocks = limit / statfsBlockSize
+	resp.Bfree = free / statfsBlockSize
+	resp.Bavail = resp.Bfree
+	resp.Namelen = 255
+	return nil
+}
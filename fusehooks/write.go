@@ -0,0 +1,513 @@
+package fusehooks
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/althk/drivefs/driveapi"
+	"github.com/althk/drivefs/writeback"
+)
+
+var errReadOnly = fuse.Errno(syscall.EROFS)
+
+// stagedFile is the local copy of a file open for writing. All handles of
+// the file read and write the copy, which is handed over for upload once
+// the last of them is released.
+type stagedFile struct {
+	file driveapi.File
+	key  string // the key in FS.staged
+	path string
+	refs int // guarded by FS.stageMu
+
+	// ready is closed once the copy is filled with the content of the
+	// file, or failed to be with err. The fields below are only set then.
+	ready chan struct{}
+	err   error
+
+	mu    sync.Mutex
+	f     *os.File
+	dirty bool
+	// base is the revision of the file on Drive the copy derives from.
+	base string
+}
+
+// wait waits until the copy is filled.
+func (sf *stagedFile) wait() error {
+	<-sf.ready
+	return sf.err
+}
+
+// filled reports whether the copy is filled successfully, without waiting.
+func (sf *stagedFile) filled() bool {
+	select {
+	case <-sf.ready:
+		return sf.err == nil
+	default:
+		return false
+	}
+}
+
+func (sf *stagedFile) size() (int64, error) {
+	st, err := sf.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), nil
+}
+
+func (sf *stagedFile) truncate(size int64) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.dirty = true
+	return sf.f.Truncate(size)
+}
+
+// stagePath returns where the local copy of file is kept. The path only
+// depends on the identity of the file, so that an interrupted upload of it
+// can be resumed from the journal.
+func (f *FS) stagePath(file driveapi.File) string {
+	sum := sha256.Sum256([]byte(writeback.Key(file)))
+	return filepath.Join(f.StageDir, hex.EncodeToString(sum[:8]))
+}
+
+// readOnly reports whether the mount rejects writes.
+func (f *FS) readOnly() bool {
+	return f.Uploader == nil
+}
+
+// lookupStaged returns the local copy of file open for writing, if any.
+// Copies are found by the identity of the file rather than by object, as
+// listing a directory again makes new objects for the same files. A copy
+// of a new file is staged under its parent and name, and still found that
+// way once the file is created on Drive. Must be called with stageMu held.
+func (f *FS) lookupStaged(file driveapi.File) (*stagedFile, bool) {
+	sf, ok := f.staged[writeback.Key(file)]
+	if !ok && file.ID() != "" {
+		sf, ok = f.staged[file.ParentID()+"/"+file.Name()]
+	}
+	return sf, ok
+}
+
+// isStaged reports whether file has a local copy open for writing.
+func (f *FS) isStaged(file driveapi.File) bool {
+	f.stageMu.Lock()
+	defer f.stageMu.Unlock()
+	_, ok := f.lookupStaged(file)
+	return ok
+}
+
+// localSize returns the size of the local copy of file if it is open for
+// writing or waiting to be uploaded.
+func (f *FS) localSize(file driveapi.File) (int64, bool) {
+	f.stageMu.Lock()
+	sf, ok := f.lookupStaged(file)
+	f.stageMu.Unlock()
+	// A copy being filled has no size of its own yet.
+	if ok && sf.filled() {
+		size, err := sf.size()
+		return size, err == nil
+	}
+	if f.Queue != nil {
+		if _, it, ok := f.Queue.Lookup(file); ok {
+			return it.Size, true
+		}
+	}
+	return 0, false
+}
+
+// openQueued opens the newest copy of file waiting to be uploaded, if any,
+// and returns the revision it derives from.
+func (f *FS) openQueued(file driveapi.File) (*os.File, string, error) {
+	if f.Queue == nil {
+		return nil, "", nil
+	}
+	path, it, ok := f.Queue.Lookup(file)
+	if !ok {
+		return nil, "", nil
+	}
+	lf, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, "", nil // Uploaded in the meantime.
+	}
+	return lf, it.Target.BaseRevision, err
+}
+
+// stage returns the local copy of file, taking a reference to it. A new
+// copy starts out empty if truncate is set, or else with the newest content
+// of the file, either waiting to be uploaded or on Drive. The copy is
+// filled without holding stageMu, so the rest of the mount goes on while
+// the content is downloaded; other callers wanting the same copy wait.
+func (f *FS) stage(ctx context.Context, file driveapi.File, truncate bool) (*stagedFile, error) {
+	f.stageMu.Lock()
+	if sf, ok := f.lookupStaged(file); ok {
+		sf.refs++
+		f.stageMu.Unlock()
+		if err := sf.wait(); err != nil {
+			return nil, err
+		}
+		if truncate {
+			if err := sf.truncate(0); err != nil {
+				f.stageMu.Lock()
+				sf.refs--
+				f.stageMu.Unlock()
+				return nil, err
+			}
+		}
+		return sf, nil
+	}
+	sf := &stagedFile{file: file, key: writeback.Key(file), path: f.stagePath(file),
+		refs: 1, ready: make(chan struct{})}
+	if f.staged == nil {
+		f.staged = make(map[string]*stagedFile)
+	}
+	f.staged[sf.key] = sf
+	f.stageMu.Unlock()
+
+	lf, err := os.OpenFile(sf.path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err == nil {
+		if sf.base, err = f.fill(ctx, file, lf, truncate); err != nil {
+			lf.Close()
+			os.Remove(sf.path)
+		}
+	}
+	if err != nil {
+		f.stageMu.Lock()
+		delete(f.staged, sf.key)
+		f.stageMu.Unlock()
+		sf.err = err
+		close(sf.ready)
+		return nil, err
+	}
+	sf.f = lf
+	close(sf.ready)
+	return sf, nil
+}
+
+// fill writes the newest content of file to w, unless truncate is set, and
+// returns the revision of the file on Drive that content derives from. The
+// revision is taken when the content is downloaded, as the one the file
+// was listed with may be long gone by then.
+func (f *FS) fill(ctx context.Context, file driveapi.File, w io.Writer, truncate bool) (string, error) {
+	var r io.ReadCloser
+	queued, base, err := f.openQueued(file)
+	switch {
+	case err != nil:
+		return "", err
+	case queued != nil:
+		r = queued
+	case truncate || file.ID() == "":
+		return file.HeadRevisionID(), nil
+	default:
+		if r, base, err = file.DownloadHead(ctx); err != nil {
+			return "", err
+		}
+	}
+	defer r.Close()
+	if truncate {
+		return base, nil
+	}
+	_, err = io.Copy(w, r)
+	return base, err
+}
+
+// unstage drops a reference to the local copy of a file. Once the last one
+// is dropped, the copy is queued for upload if it was modified, or else
+// removed. Without a queue, it is uploaded right away.
+func (f *FS) unstage(ctx context.Context, sf *stagedFile) error {
+	f.stageMu.Lock()
+	sf.refs--
+	if sf.refs > 0 {
+		f.stageMu.Unlock()
+		return nil
+	}
+	delete(f.staged, sf.key)
+	f.stageMu.Unlock()
+
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if sf.dirty && f.Queue != nil {
+		// The copy must be on disk before close returns, as it is the
+		// only one until the upload is done.
+		if err := sf.f.Sync(); err != nil {
+			sf.f.Close()
+			return err
+		}
+	}
+	if err := sf.f.Close(); err != nil {
+		return err
+	}
+	if sf.dirty && f.Queue != nil {
+		return f.Queue.Enqueue(sf.file, sf.path, sf.base)
+	}
+	if sf.dirty {
+		start := time.Now()
+		if _, err := sf.file.Upload(ctx, f.Uploader, sf.path, sf.base); err != nil {
+			f.logger().Error("upload failed, local copy kept", "op", "upload",
+				"file", sf.file.ID(), "name", sf.file.Name(), "path", sf.path, "err", err)
+			return err
+		}
+		f.logger().Info("uploaded", "op", "upload", "file", sf.file.ID(),
+			"name", sf.file.Name(), "latency", time.Since(start))
+	}
+	return os.Remove(sf.path)
+}
+
+// commit uploads the current content of a local copy and waits until it
+// is on Drive, along with any earlier queued content of the file.
+func (f *FS) commit(ctx context.Context, sf *stagedFile) error {
+	key := writeback.Key(sf.file)
+	sf.mu.Lock()
+	if sf.dirty && f.Queue == nil {
+		rev, err := sf.file.Upload(ctx, f.Uploader, sf.path, sf.base)
+		if err == nil {
+			sf.dirty = false
+			if rev != "" {
+				sf.base = rev
+			}
+		}
+		sf.mu.Unlock()
+		return err
+	}
+	if sf.dirty {
+		// The copy stays open for writing, so a snapshot of it is queued.
+		path, err := f.snapshot(sf)
+		if err == nil {
+			err = f.Queue.Enqueue(sf.file, path, sf.base)
+		}
+		if err != nil {
+			os.Remove(path)
+			sf.mu.Unlock()
+			return err
+		}
+		sf.dirty = false
+	}
+	sf.mu.Unlock()
+	if f.Queue == nil {
+		return nil
+	}
+	if err := f.Queue.WaitKey(ctx, key); err != nil {
+		return err
+	}
+	// Later content of the copy derives from what was just uploaded.
+	sf.mu.Lock()
+	sf.base = f.Queue.Rebase(key, sf.base)
+	sf.mu.Unlock()
+	return nil
+}
+
+// snapshot copies a local copy to a new file synced to disk, and returns
+// its path. Must be called with sf.mu held.
+func (f *FS) snapshot(sf *stagedFile) (string, error) {
+	tmp, err := os.CreateTemp(f.StageDir, "snapshot-")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, io.NewSectionReader(sf.f, 0, 1<<62))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	return tmp.Name(), err
+}
+
+var _ = fs.NodeCreater(&Dir{})
+
+func (d *Dir) Create(
+	ctx context.Context, req *fuse.CreateRequest,
+	resp *fuse.CreateResponse) (_ fs.Node, _ fs.Handle, err error) {
+	defer observe("create", time.Now(), &err)
+	if d.fs.readOnly() {
+		return nil, nil, errReadOnly
+	}
+	if req.Name == controlDirName && d.isRoot() {
+		return nil, nil, fuse.Errno(syscall.EEXIST)
+	}
+	files, err := d.ListFiles(ctx)
+	if err != nil {
+		return nil, nil, d.fs.fail("create", req.Name, err)
+	}
+	var child driveapi.File
+	for _, f := range files {
+		if f.Name() == req.Name {
+			child = f
+			break
+		}
+	}
+	truncate := true
+	switch {
+	case child == nil:
+		if child, err = d.NewChild(req.Name); err != nil {
+			return nil, nil, d.fs.fail("create", req.Name, err)
+		}
+	case req.Flags&fuse.OpenExclusive != 0:
+		return nil, nil, fuse.Errno(syscall.EEXIST)
+	case child.IsDir():
+		return nil, nil, fuse.Errno(syscall.EISDIR)
+	default:
+		// The kernel did not know of the file, e.g. from a stale negative
+		// lookup, so it is opened as an existing file would have been.
+		truncate = req.Flags&fuse.OpenTruncate != 0
+	}
+	sf, err := d.fs.stage(ctx, child, truncate)
+	if err != nil {
+		return nil, nil, d.fs.fail("create", req.Name, err)
+	}
+	if truncate {
+		// The file must be created, or emptied, even if nothing is written.
+		sf.mu.Lock()
+		sf.dirty = true
+		sf.mu.Unlock()
+	}
+	return &File{file: child, fs: d.fs}, opened(&WriteHandle{fs: d.fs, sf: sf}), nil
+}
+
+var _ = fs.NodeSetattrer(&File{})
+
+func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	defer observe("setattr", time.Now(), &err)
+	if req.Valid.Size() {
+		if f.fs.readOnly() {
+			return errReadOnly
+		}
+		sf, err := f.fs.stage(ctx, f.file, req.Size == 0)
+		if err != nil {
+			return err
+		}
+		err = sf.truncate(int64(req.Size))
+		if uerr := f.fs.unstage(ctx, sf); err == nil {
+			err = uerr
+		}
+		if err != nil {
+			return f.fs.fail("truncate", f.file.Name(), err)
+		}
+	}
+	return f.Attr(ctx, &resp.Attr)
+}
+
+var _ fs.NodeFsyncer = (*File)(nil)
+
+// Fsync returns once everything written to the file is on Drive. It fails
+// if an upload attempt fails in the meantime.
+func (f *File) Fsync(ctx context.Context, _ *fuse.FsyncRequest) (err error) {
+	defer observe("fsync", time.Now(), &err)
+	f.fs.stageMu.Lock()
+	sf, ok := f.fs.lookupStaged(f.file)
+	if ok {
+		sf.refs++
+	}
+	f.fs.stageMu.Unlock()
+	if ok {
+		if err := sf.wait(); err != nil {
+			return f.fs.fail("fsync", f.file.Name(), err)
+		}
+		err := f.fs.commit(ctx, sf)
+		if uerr := f.fs.unstage(ctx, sf); err == nil {
+			err = uerr
+		}
+		return f.fs.fail("fsync", f.file.Name(), err)
+	}
+	if f.fs.Queue == nil {
+		return nil
+	}
+	return f.fs.fail("fsync", f.file.Name(), f.fs.Queue.WaitKey(ctx, writeback.Key(f.file)))
+}
+
+var _ fs.NodeFsyncer = (*Dir)(nil)
+
+// Fsync is a no-op, as directories are only changed on Drive directly.
+func (d *Dir) Fsync(context.Context, *fuse.FsyncRequest) error {
+	return nil
+}
+
+// WriteHandle is a handle to the local copy of a file open for writing.
+type WriteHandle struct {
+	fs *FS
+	sf *stagedFile
+}
+
+var _ = fs.HandleReader(&WriteHandle{})
+
+func (wh *WriteHandle) Read(_ context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	defer observe("read", time.Now(), &err)
+	buf := make([]byte, req.Size)
+	n, err := wh.sf.f.ReadAt(buf, req.Offset)
+	resp.Data = buf[:n]
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+var _ = fs.HandleWriter(&WriteHandle{})
+
+func (wh *WriteHandle) Write(_ context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	defer observe("write", time.Now(), &err)
+	wh.sf.mu.Lock()
+	defer wh.sf.mu.Unlock()
+	n, err := wh.sf.f.WriteAt(req.Data, req.Offset)
+	resp.Size = n
+	wh.sf.dirty = true
+	return err
+}
+
+var _ fs.HandleFlusher = (*WriteHandle)(nil)
+
+// Flush is called on every close of the handle. The written data is synced
+// to the local copy, or with SyncOnClose, uploaded.
+func (wh *WriteHandle) Flush(ctx context.Context, _ *fuse.FlushRequest) (err error) {
+	defer observe("flush", time.Now(), &err)
+	if wh.fs.SyncOnClose {
+		err = wh.fs.commit(ctx, wh.sf)
+	} else {
+		wh.sf.mu.Lock()
+		err = wh.sf.f.Sync()
+		wh.sf.mu.Unlock()
+	}
+	return wh.fs.fail("flush", wh.sf.file.Name(), err)
+}
+
+var _ fs.HandleReleaser = (*WriteHandle)(nil)
+
+func (wh *WriteHandle) Release(ctx context.Context, _ *fuse.ReleaseRequest) (err error) {
+	defer observe("release", time.Now(), &err)
+	openHandles.Add(-1)
+	return wh.fs.fail("release", wh.sf.file.Name(), wh.fs.unstage(ctx, wh.sf))
+}
+
+// QueuedHandle is a read-only handle to the local copy of a file that is
+// waiting to be uploaded.
+type QueuedHandle struct {
+	f *os.File
+}
+
+var _ = fs.HandleReader(&QueuedHandle{})
+
+func (qh *QueuedHandle) Read(_ context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	defer observe("read", time.Now(), &err)
+	buf := make([]byte, req.Size)
+	n, err := qh.f.ReadAt(buf, req.Offset)
+	resp.Data = buf[:n]
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+var _ fs.HandleReleaser = (*QueuedHandle)(nil)
+
+func (qh *QueuedHandle) Release(_ context.Context, _ *fuse.ReleaseRequest) (err error) {
+	defer observe("release", time.Now(), &err)
+	openHandles.Add(-1)
+	return qh.f.Close()
+}
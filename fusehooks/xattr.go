@@ -0,0 +1,192 @@
+package fusehooks
+
+import (
+	"context"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/althk/drivefs/driveapi"
+)
+
+// Extended attributes exposed for every file and dir. The id and mime type
+// are read-only, the description and custom properties are writable and
+// map to the file metadata on Drive.
+const (
+	xattrID                  = "user.drive.id"
+	xattrMimeType            = "user.drive.mimetype"
+	xattrDescription         = "user.drive.description"
+	xattrPropertiesPrefix    = "user.drive.properties."
+	xattrAppPropertiesPrefix = "user.drive.appProperties."
+)
+
+// Setxattr flags, see setxattr(2).
+const (
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+)
+
+var errXattrNotSupported = fuse.Errno(syscall.ENOTSUP)
+
+// propertyXattr returns the Drive property scope and key that the given
+// xattr name maps to.
+func propertyXattr(name string) (scope int, key string, ok bool) {
+	switch {
+	case strings.HasPrefix(name, xattrPropertiesPrefix):
+		scope, key = driveapi.PropertyScopePublic, name[len(xattrPropertiesPrefix):]
+	case strings.HasPrefix(name, xattrAppPropertiesPrefix):
+		scope, key = driveapi.PropertyScopePrivate, name[len(xattrAppPropertiesPrefix):]
+	default:
+		return 0, "", false
+	}
+	return scope, key, key != ""
+}
+
+func getxattr(f driveapi.File, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	var v string
+	switch req.Name {
+	case xattrID:
+		v = f.ID()
+	case xattrMimeType:
+		v = f.MimeType()
+	case xattrDescription:
+		v = f.Description()
+		if v == "" {
+			return fuse.ErrNoXattr
+		}
+	default:
+		scope, key, ok := propertyXattr(req.Name)
+		if !ok {
+			return fuse.ErrNoXattr
+		}
+		if v, ok = f.Properties(scope)[key]; !ok {
+			return fuse.ErrNoXattr
+		}
+	}
+	resp.Xattr = []byte(v)
+	return nil
+}
+
+func listxattr(f driveapi.File, resp *fuse.ListxattrResponse) {
+	resp.Append(xattrID, xattrMimeType)
+	if f.Description() != "" {
+		resp.Append(xattrDescription)
+	}
+	for k := range f.Properties(driveapi.PropertyScopePublic) {
+		resp.Append(xattrPropertiesPrefix + k)
+	}
+	for k := range f.Properties(driveapi.PropertyScopePrivate) {
+		resp.Append(xattrAppPropertiesPrefix + k)
+	}
+}
+
+func setxattr(ctx context.Context, f driveapi.File, req *fuse.SetxattrRequest) error {
+	var exists bool
+	switch req.Name {
+	case xattrID, xattrMimeType:
+		return fuse.EPERM
+	case xattrDescription:
+		exists = f.Description() != ""
+	default:
+		scope, key, ok := propertyXattr(req.Name)
+		if !ok {
+			return errXattrNotSupported
+		}
+		_, exists = f.Properties(scope)[key]
+	}
+	if exists && req.Flags&xattrCreate != 0 {
+		return fuse.Errno(syscall.EEXIST)
+	}
+	if !exists && req.Flags&xattrReplace != 0 {
+		return fuse.ErrNoXattr
+	}
+
+	if req.Name == xattrDescription {
+		return f.SetDescription(ctx, string(req.Xattr))
+	}
+	scope, key, _ := propertyXattr(req.Name)
+	return f.SetProperty(ctx, scope, key, string(req.Xattr))
+}
+
+func removexattr(ctx context.Context, f driveapi.File, req *fuse.RemovexattrRequest) error {
+	switch req.Name {
+	case xattrID, xattrMimeType:
+		return fuse.EPERM
+	case xattrDescription:
+		if f.Description() == "" {
+			return fuse.ErrNoXattr
+		}
+		return f.SetDescription(ctx, "")
+	}
+	scope, key, ok := propertyXattr(req.Name)
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+	if err := f.RemoveProperty(ctx, scope, key); err != nil {
+		if err == driveapi.ErrNoProperty {
+			return fuse.ErrNoXattr
+		}
+		return err
+	}
+	return nil
+}
+
+var _ fs.NodeGetxattrer = (*Dir)(nil)
+
+func (d *Dir) Getxattr(_ context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) (err error) {
+	defer observe("getxattr", time.Now(), &err)
+	return getxattr(d.File, req, resp)
+}
+
+var _ fs.NodeListxattrer = (*Dir)(nil)
+
+func (d *Dir) Listxattr(_ context.Context, _ *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) (err error) {
+	defer observe("listxattr", time.Now(), &err)
+	listxattr(d.File, resp)
+	return nil
+}
+
+var _ fs.NodeSetxattrer = (*Dir)(nil)
+
+func (d *Dir) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) (err error) {
+	defer observe("setxattr", time.Now(), &err)
+	return setxattr(ctx, d.File, req)
+}
+
+var _ fs.NodeRemovexattrer = (*Dir)(nil)
+
+func (d *Dir) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) (err error) {
+	defer observe("removexattr", time.Now(), &err)
+	return removexattr(ctx, d.File, req)
+}
+
+var _ fs.NodeGetxattrer = (*File)(nil)
+
+func (f *File) Getxattr(_ context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) (err error) {
+	defer observe("getxattr", time.Now(), &err)
+	return getxattr(f.file, req, resp)
+}
+
+var _ fs.NodeListxattrer = (*File)(nil)
+
+func (f *File) Listxattr(_ context.Context, _ *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) (err error) {
+	defer observe("listxattr", time.Now(), &err)
+	listxattr(f.file, resp)
+	return nil
+}
+
+var _ fs.NodeSetxattrer = (*File)(nil)
+
+func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) (err error) {
+	defer observe("setxattr", time.Now(), &err)
+	return setxattr(ctx, f.file, req)
+}
+
+var _ fs.NodeRemovexattrer = (*File)(nil)
+
+func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) (err error) {
+	defer observe("removexattr", time.Now(), &err)
+	return removexattr(ctx, f.file, req)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// isHelper reports whether drivefs runs as a mount helper: installed as
+// mount.drivefs or mount.fuse.drivefs, which mount(8) runs for file systems
+// of type drivefs and fuse.drivefs, or run by mount.fuse, which passes the
+// source and the mount point followed by -o options or -t type. Two bare
+// arguments alone, as in a mistyped command, are not a mount.
+func isHelper(prog string, args []string) bool {
+	if strings.HasPrefix(filepath.Base(prog), "mount.") {
+		return true
+	}
+	if len(args) < 3 || commandNamed(args[0]) != nil ||
+		strings.HasPrefix(args[0], "-") || strings.HasPrefix(args[1], "-") {
+		return false
+	}
+	for _, a := range args[2:] {
+		if strings.HasPrefix(a, "-o") || a == "-t" {
+			return true
+		}
+	}
+	return false
+}
+
+// fstabOptions are the mount options that are meant for mount(8) or
+// systemd rather than the file system.
+var fstabOptions = map[string]bool{
+	"defaults": true, "auto": true, "noauto": true, "user": true,
+	"nouser": true, "users": true, "owner": true, "group": true,
+	"nofail": true, "_netdev": true, "exec": true, "noexec": true,
+	"dev": true, "nodev": true, "suid": true, "nosuid": true,
+	"atime": true, "noatime": true, "relatime": true, "comment": true,
+}
+
+// helperArgs returns the mount command arguments of the mount helper
+// arguments, as in
+//
+//	mount.drivefs source mountpoint [-n] [-s] [-v] [-f] [-o options]
+//
+// The source names a profile if isProfile says so, given the path of the
+// configuration file ("" for the default one), and otherwise the folder to
+// use as the root; drivefs or none stand for My Drive. Options named like
+// mount flags set them, as in tokenfile=/etc/drivefs/token.json or
+// readwrite, fstab options such as noauto and _netdev are ignored, and the
+// others are FUSE mount options. Nil arguments mean there is nothing to do.
+func helperArgs(args []string, isProfile func(config, name string) bool) ([]string, error) {
+	var pos, opts []string
+	fake := false
+	for i := 0; i < len(args); i++ {
+		switch a := args[i]; {
+		case a == "-o":
+			if i++; i == len(args) {
+				return nil, fmt.Errorf("missing options after -o")
+			}
+			opts = append(opts, strings.Split(args[i], ",")...)
+		case strings.HasPrefix(a, "-o"):
+			opts = append(opts, strings.Split(a[2:], ",")...)
+		case a == "-f":
+			fake = true
+		case a == "-n" || a == "-s" || a == "-v":
+		case a == "-t":
+			// The type, given by mount.fuse.
+			i++
+		case strings.HasPrefix(a, "-"):
+			return nil, fmt.Errorf("unknown mount helper flag %q", a)
+		default:
+			pos = append(pos, a)
+		}
+	}
+	if len(pos) != 2 {
+		return nil, fmt.Errorf("want a source and a mount point, got %q", pos)
+	}
+	if fake {
+		return nil, nil
+	}
+
+	margs := []string{"-daemon"}
+	var fuseOpts []string
+	config := ""
+	for _, opt := range opts {
+		if opt = strings.TrimSpace(opt); opt == "" {
+			continue
+		}
+		key := opt
+		if i := strings.Index(opt, "="); i >= 0 {
+			key = opt[:i]
+		}
+		switch {
+		case fstabOptions[key] || strings.HasPrefix(key, "x-"):
+		case key == "config" || key == "profile" || isSetting(key):
+			if key == "config" && key != opt {
+				config = opt[len(key)+1:]
+			}
+			margs = append(margs, "-"+opt)
+		default:
+			fuseOpts = append(fuseOpts, opt)
+		}
+	}
+	if len(fuseOpts) > 0 {
+		margs = append(margs, "-o", strings.Join(fuseOpts, ","))
+	}
+	switch src := pos[0]; {
+	case src == "drivefs" || src == "none":
+	case isProfile(config, src):
+		margs = append(margs, "-profile", src)
+	default:
+		margs = append(margs, "-root", src)
+	}
+	return append(margs, "-mntpoint", pos[1]), nil
+}
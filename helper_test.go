@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHelperArgs(t *testing.T) {
+	isProfile := func(config, name string) bool {
+		return config == "/etc/drivefs.json" && name == "work"
+	}
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{
+			[]string{"work", "/mnt/work", "-o", "rw,noauto,_netdev,x-systemd.automount,config=/etc/drivefs.json,readwrite,allow_other,uid=1000"},
+			[]string{"-daemon", "-config=/etc/drivefs.json", "-readwrite", "-o", "rw,allow_other,uid=1000", "-profile", "work", "-mntpoint", "/mnt/work"},
+		},
+		{
+			[]string{"/Photos", "/mnt/photos", "-n", "-otokenfile=/etc/drivefs/token.json,defaults"},
+			[]string{"-daemon", "-tokenfile=/etc/drivefs/token.json", "-root", "/Photos", "-mntpoint", "/mnt/photos"},
+		},
+		{
+			[]string{"drivefs", "/mnt/drive"},
+			[]string{"-daemon", "-mntpoint", "/mnt/drive"},
+		},
+		{
+			[]string{"drivefs", "/mnt/drive", "-f", "-o", "ro"},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		got, err := helperArgs(tt.args, isProfile)
+		if err != nil {
+			t.Errorf("helperArgs(%q) error = %v", tt.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("helperArgs(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	for _, bad := range [][]string{{"/mnt/drive"}, {"a", "b", "c"}, {"a", "b", "-o"}, {"a", "b", "-x"}} {
+		if _, err := helperArgs(bad, isProfile); err == nil {
+			t.Errorf("helperArgs(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestIsHelper(t *testing.T) {
+	tests := []struct {
+		prog string
+		args []string
+		want bool
+	}{
+		{"/sbin/mount.drivefs", []string{"work", "/mnt/work"}, true},
+		{"/sbin/mount.fuse.drivefs", []string{"work", "/mnt/work"}, true},
+		{"drivefs", []string{"work", "/mnt/work", "-o", "rw"}, true},
+		{"drivefs", []string{"work", "/mnt/work", "-orw"}, true},
+		{"drivefs", []string{"work", "/mnt/work", "-t", "fuse.drivefs"}, true},
+		{"drivefs", []string{"lst", "/x"}, false},
+		{"drivefs", []string{"work", "/mnt/work"}, false},
+		{"drivefs", []string{"work", "/mnt/work", "-v"}, false},
+		{"drivefs", []string{"mount", "/mnt/work"}, false},
+		{"drivefs", []string{"/mnt/work"}, false},
+		{"drivefs", []string{"-mntpoint", "/mnt/work"}, false},
+	}
+	for _, tt := range tests {
+		if got := isHelper(tt.prog, tt.args); got != tt.want {
+			t.Errorf("isHelper(%q, %q) = %v, want %v", tt.prog, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestWritePidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "drivefs.pid")
+	if err := writePidFile(path); err != nil {
+		t.Fatalf("writePidFile() error = %v", err)
+	}
+	// This process still runs.
+	if err := writePidFile(path); err == nil {
+		t.Error("writePidFile() succeeded with the process in the pidfile running")
+	}
+	// A pid that cannot be running is stale.
+	if err := os.WriteFile(path, []byte("999999999\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePidFile(path); err != nil {
+		t.Errorf("writePidFile() over a stale pidfile error = %v", err)
+	}
+}
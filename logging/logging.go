@@ -0,0 +1,213 @@
+// Package logging is a small structured, leveled logger.
+//
+// Every entry has a level, a message and a list of key/value fields, and
+// is written on a single line either as text:
+//
+//	2021-03-04T05:06:07.890Z INFO uploaded file=fid1 size=42 latency=1.2s
+//
+// or as a JSON object with the time, level and msg keys besides the fields.
+// A nil *Logger discards everything, so libraries can log unconditionally.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of a log entry.
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("level(%d)", int32(l))
+}
+
+// ParseLevel parses a level name, one of debug, info, warn or error.
+func ParseLevel(s string) (Level, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// Format is how entries are written.
+type Format int
+
+const (
+	FormatText Format = iota
+	FormatJSON
+)
+
+// ParseFormat parses a format name, either text or json.
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "text":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return 0, fmt.Errorf("unknown log format %q", s)
+}
+
+// output is shared by a logger and the loggers derived from it.
+type output struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format Format
+	level  int32 // a Level, accessed atomically
+}
+
+// Logger writes log entries. Loggers derived from one by With share its
+// output and level.
+type Logger struct {
+	out    *output
+	fields []interface{}
+}
+
+// New returns a logger writing entries at level or above to w.
+func New(w io.Writer, level Level, format Format) *Logger {
+	return &Logger{out: &output{w: w, format: format, level: int32(level)}}
+}
+
+// SetLevel changes the minimum level of the entries written, for the
+// logger and all the loggers sharing its output.
+func (l *Logger) SetLevel(level Level) {
+	if l != nil {
+		atomic.StoreInt32(&l.out.level, int32(level))
+	}
+}
+
+// Level returns the minimum level of the entries written.
+func (l *Logger) Level() Level {
+	if l == nil {
+		return LevelError + 1
+	}
+	return Level(atomic.LoadInt32(&l.out.level))
+}
+
+// Enabled reports whether entries at level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return l != nil && level >= l.Level()
+}
+
+// With returns a logger adding the given key/value pairs to every entry.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	fields := append(append([]interface{}(nil), l.fields...), kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "<missing>")
+	}
+	now := time.Now().UTC()
+	var b bytes.Buffer
+	if l.out.format == FormatJSON {
+		writeJSON(&b, now, level, msg, fields)
+	} else {
+		writeText(&b, now, level, msg, fields)
+	}
+	b.WriteByte('\n')
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(b.Bytes())
+}
+
+const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+func writeText(b *bytes.Buffer, t time.Time, level Level, msg string, fields []interface{}) {
+	b.WriteString(t.Format(timeFormat))
+	b.WriteByte(' ')
+	b.WriteString(strings.ToUpper(level.String()))
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(fields); i += 2 {
+		b.WriteByte(' ')
+		b.WriteString(fmt.Sprint(fields[i]))
+		b.WriteByte('=')
+		s := fmt.Sprint(value(fields[i+1]))
+		if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+			s = strconv.Quote(s)
+		}
+		b.WriteString(s)
+	}
+}
+
+func writeJSON(b *bytes.Buffer, t time.Time, level Level, msg string, fields []interface{}) {
+	b.WriteString(`{"time":`)
+	writeJSONValue(b, t.Format(timeFormat))
+	b.WriteString(`,"level":`)
+	writeJSONValue(b, level.String())
+	b.WriteString(`,"msg":`)
+	writeJSONValue(b, msg)
+	for i := 0; i < len(fields); i += 2 {
+		b.WriteByte(',')
+		writeJSONValue(b, fmt.Sprint(fields[i]))
+		b.WriteByte(':')
+		writeJSONValue(b, value(fields[i+1]))
+	}
+	b.WriteByte('}')
+}
+
+func writeJSONValue(b *bytes.Buffer, v interface{}) {
+	enc, err := json.Marshal(v)
+	if err != nil {
+		enc, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(enc)
+}
+
+// value returns how a field value is logged. Errors and durations are
+// logged as their string form rather than as structs or numbers.
+func value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		if v == nil {
+			return nil
+		}
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
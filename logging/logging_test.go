@@ -0,0 +1,65 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogger_Text(t *testing.T) {
+	var b bytes.Buffer
+	l := New(&b, LevelInfo, FormatText).With("op", "read")
+	l.Debug("hidden")
+	l.Info("read done", "file", "fid1", "latency", 1500*time.Millisecond, "err", errors.New("bad thing"))
+	got := b.String()
+	if strings.Contains(got, "hidden") {
+		t.Errorf("debug entry written at info level: %q", got)
+	}
+	want := ` INFO read done op=read file=fid1 latency=1.5s err="bad thing"` + "\n"
+	if !strings.HasSuffix(got, want) {
+		t.Errorf("text entry = %q, want suffix %q", got, want)
+	}
+
+	b.Reset()
+	l.SetLevel(LevelDebug)
+	l.Debug("shown")
+	if !strings.Contains(b.String(), "DEBUG shown op=read") {
+		t.Errorf("after SetLevel(debug) entry = %q", b.String())
+	}
+}
+
+func TestLogger_JSON(t *testing.T) {
+	var b bytes.Buffer
+	l := New(&b, LevelDebug, FormatJSON)
+	l.Warn("upload failed", "size", 42, "err", errors.New("timeout"))
+	var entry map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &entry); err != nil {
+		t.Fatalf("JSON entry %q does not parse: %v", b.String(), err)
+	}
+	if entry["level"] != "warn" || entry["msg"] != "upload failed" ||
+		entry["size"] != 42.0 || entry["err"] != "timeout" {
+		t.Errorf("JSON entry = %v", entry)
+	}
+}
+
+func TestLogger_Nil(t *testing.T) {
+	var l *Logger
+	l.With("k", "v").Error("discarded")
+	if l.Enabled(LevelError) {
+		t.Error("nil logger Enabled() = true")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, s := range []string{"debug", "INFO", "Warn", "error"} {
+		if _, err := ParseLevel(s); err != nil {
+			t.Errorf("ParseLevel(%q) error = %v", s, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("ParseLevel(verbose) error = nil")
+	}
+}
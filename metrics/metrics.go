@@ -0,0 +1,316 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the Prometheus text exposition format.
+//
+// Metrics are created once, usually as package variables, and registered
+// in a Registry, the Default one unless stated otherwise:
+//
+//	var reads = metrics.NewCounter("drivefs_reads_total", "Reads served.", "op")
+//
+//	reads.Inc("read")
+//
+// Label values are given in the order the label names were declared.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram buckets suited to operation latencies, in
+// seconds.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Default is the registry the package level constructors register in.
+var Default = NewRegistry()
+
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// Registry is a set of metrics that are exposed together.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// register adds m, replacing any metric with the same name.
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, old := range r.metrics {
+		if old.name() == m.name() {
+			r.metrics[i] = m
+			return
+		}
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteText writes all the metrics in the Prometheus text format, sorted by
+// name.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	ms := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+	sort.Slice(ms, func(i, j int) bool { return ms[i].name() < ms[j].name() })
+	bw := bufio.NewWriter(w)
+	for _, m := range ms {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP serves the metrics, as expected at /metrics.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteText(w)
+}
+
+// desc is the name, help and label names shared by all kinds of metrics.
+type desc struct {
+	fqName string
+	help   string
+	labels []string
+}
+
+func (d *desc) name() string { return d.fqName }
+
+func (d *desc) header(w *bufio.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.fqName, strings.ReplaceAll(d.help, "\n", " "))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.fqName, typ)
+}
+
+// key joins label values into a map key. The values are checked against
+// the declared labels.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, got %d",
+			d.fqName, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// series formats the name and labels of a series. extra is an additional
+// label name and value pair, such as le for histogram buckets.
+func (d *desc) series(suffix, key string, extra ...string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+"="+quote(v))
+		}
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, extra[0]+"="+quote(extra[1]))
+	}
+	if len(pairs) == 0 {
+		return d.fqName + suffix
+	}
+	return d.fqName + suffix + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func quote(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// valueVec is a set of values by label values, shared by counters and
+// gauges.
+type valueVec struct {
+	desc
+	typ    string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (v *valueVec) add(delta float64, labels []string) {
+	k := v.key(labels)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[k] += delta
+}
+
+func (v *valueVec) write(w *bufio.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.header(w, v.typ)
+	for _, k := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s %s\n", v.series("", k), formatFloat(v.values[k]))
+	}
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	v *valueVec
+}
+
+// NewCounter returns a counter registered in r.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{&valueVec{
+		desc:   desc{fqName: name, help: help, labels: labels},
+		typ:    "counter",
+		values: make(map[string]float64),
+	}}
+	r.register(c.v)
+	return c
+}
+
+// NewCounter returns a counter registered in the Default registry.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+func (c *Counter) Inc(labels ...string) {
+	c.v.add(1, labels)
+}
+
+// Add adds delta, which must not be negative.
+func (c *Counter) Add(delta float64, labels ...string) {
+	if delta < 0 {
+		panic("metrics: counter decreased")
+	}
+	c.v.add(delta, labels)
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct {
+	v *valueVec
+}
+
+// NewGauge returns a gauge registered in r.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{&valueVec{
+		desc:   desc{fqName: name, help: help, labels: labels},
+		typ:    "gauge",
+		values: make(map[string]float64),
+	}}
+	r.register(g.v)
+	return g
+}
+
+// NewGauge returns a gauge registered in the Default registry.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+func (g *Gauge) Add(delta float64, labels ...string) {
+	g.v.add(delta, labels)
+}
+
+func (g *Gauge) Set(value float64, labels ...string) {
+	k := g.v.key(labels)
+	g.v.mu.Lock()
+	defer g.v.mu.Unlock()
+	g.v.values[k] = value
+}
+
+// gaugeFunc is a gauge whose value is computed when the metrics are
+// written.
+type gaugeFunc struct {
+	desc
+	fn func() float64
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	g.header(w, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.fqName, formatFloat(g.fn()))
+}
+
+// NewGaugeFunc registers in r a gauge whose value is returned by fn.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&gaugeFunc{desc: desc{fqName: name, help: help}, fn: fn})
+}
+
+// Histogram counts observed values in buckets.
+type Histogram struct {
+	desc
+	buckets []float64 // upper bounds, ascending
+
+	mu     sync.Mutex
+	counts map[string][]uint64 // by label values, one per bucket
+	sums   map[string]float64
+	totals map[string]uint64
+}
+
+// NewHistogram returns a histogram registered in r, with the given bucket
+// upper bounds.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		desc:    desc{fqName: name, help: help, labels: labels},
+		buckets: append([]float64(nil), buckets...),
+		counts:  make(map[string][]uint64),
+		sums:    make(map[string]float64),
+		totals:  make(map[string]uint64),
+	}
+	sort.Float64s(h.buckets)
+	r.register(h)
+	return h
+}
+
+// NewHistogram returns a histogram registered in the Default registry.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+func (h *Histogram) Observe(v float64, labels ...string) {
+	k := h.key(labels)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	counts, ok := h.counts[k]
+	if !ok {
+		counts = make([]uint64, len(h.buckets))
+		h.counts[k] = counts
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			counts[i]++
+		}
+	}
+	h.sums[k] += v
+	h.totals[k]++
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w, "histogram")
+	for _, k := range sortedKeys(h.sums) {
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s %d\n", h.series("_bucket", k, "le", formatFloat(b)), h.counts[k][i])
+		}
+		fmt.Fprintf(w, "%s %d\n", h.series("_bucket", k, "le", "+Inf"), h.totals[k])
+		fmt.Fprintf(w, "%s %s\n", h.series("_sum", k), formatFloat(h.sums[k]))
+		fmt.Fprintf(w, "%s %d\n", h.series("_count", k), h.totals[k])
+	}
+}
@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WriteText(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_calls_total", "Calls made.", "method", "status")
+	c.Inc("GET", "200")
+	c.Add(2, "GET", "200")
+	c.Inc("POST", `5"0\0`)
+	g := r.NewGauge("test_open", "Open things.")
+	g.Add(3)
+	g.Add(-1)
+	r.NewGaugeFunc("test_ratio", "A ratio.", func() float64 { return 0.5 })
+	h := r.NewHistogram("test_duration_seconds", "Durations.", []float64{0.1, 1}, "op")
+	h.Observe(0.05, "read")
+	h.Observe(0.5, "read")
+	h.Observe(5, "read")
+
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_calls_total Calls made.
+# TYPE test_calls_total counter
+test_calls_total{method="GET",status="200"} 3
+test_calls_total{method="POST",status="5\"0\\0"} 1
+# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{op="read",le="0.1"} 1
+test_duration_seconds_bucket{op="read",le="1"} 2
+test_duration_seconds_bucket{op="read",le="+Inf"} 3
+test_duration_seconds_sum{op="read"} 5.55
+test_duration_seconds_count{op="read"} 3
+# HELP test_open Open things.
+# TYPE test_open gauge
+test_open 2
+# HELP test_ratio A ratio.
+# TYPE test_ratio gauge
+test_ratio 0.5
+`
+	if b.String() != want {
+		t.Errorf("WriteText() =\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestRegistry_ServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "Things.").Inc()
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "test_total 1\n") {
+		t.Errorf("body = %q", rec.Body.String())
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/althk/drivefs/cache"
+	"github.com/althk/drivefs/driveapi"
+	"github.com/althk/drivefs/fusehooks"
+	"github.com/althk/drivefs/metrics"
+	"github.com/althk/drivefs/sdnotify"
+	"github.com/althk/drivefs/writeback"
+)
+
+// runMount mounts Drive and serves it until interrupted.
+func runMount(ctx context.Context, o *options, args []string) error {
+	if o.mountPath == "" && len(args) > 0 {
+		o.mountPath = args[0]
+	}
+	if o.mountPath == "" || len(args) > 1 ||
+		o.writeMode != "async" && o.writeMode != "sync" {
+		return errUsage
+	}
+	fc, err := parseMountOptions(o.mountOpts)
+	if err != nil {
+		return err
+	}
+	if fc.readOnly {
+		o.readWrite = false
+	}
+	if o.daemon && !isDaemon() {
+		return daemonize(o)
+	}
+	if isDaemon() {
+		o.passphraseFD = -1
+	}
+	// The file system and uploads keep running past ctx, until the
+	// shutdown is done.
+	sigCtx := ctx
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	client, err := newClient(o)
+	if err != nil {
+		return err
+	}
+	if err := driveapi.CheckScope(ctx, client); errors.Is(err, driveapi.ErrFileScopeOnly) {
+		return err
+	} else if err != nil {
+		logger.Warn("unable to check the token scope", "err", err)
+	}
+	calls := &driveapi.CallCounter{Base: client.Transport}
+	client.Transport = calls
+	svc, err := newService(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	driveapi.SetListTTL(o.listTTL)
+	dfs := &fusehooks.FS{
+		Ctx:      ctx,
+		DriveSvc: svc,
+		Folder:   o.root,
+		Perms:    &fc.perms,
+		Cache:    cache.New(o.cacheSize << 20),
+		StageDir: filepath.Join(o.cacheDir, "staging"),
+
+		SyncOnClose: o.writeMode == "sync",
+		Calls:       calls,
+		Config:      o.values,
+		Log:         logger,
+	}
+	if o.readWrite {
+		if err := os.MkdirAll(dfs.StageDir, 0700); err != nil {
+			return err
+		}
+		journal, err := driveapi.NewJournal(filepath.Join(o.cacheDir, "uploads"))
+		if err != nil {
+			return err
+		}
+		dfs.Uploader = &driveapi.Uploader{
+			Client:     client,
+			Service:    svc,
+			ChunkSize:  o.chunkSize << 20,
+			Journal:    journal,
+			MaxRetries: 5,
+		}
+		if dfs.Queue, err = writeback.Open(filepath.Join(o.cacheDir, "queue"), dfs.Uploader); err != nil {
+			return err
+		}
+		if n := dfs.Queue.Len(); n > 0 {
+			logger.Info("resuming pending uploads", "count", n)
+		}
+		dfs.Queue.Start(ctx, o.uploadWorkers)
+	}
+	if o.metricsAddr != "" {
+		dfs.RegisterMetrics(metrics.Default)
+		go serveMetrics(o.metricsAddr)
+	}
+	// Resolve the root before mounting so that a missing folder fails the
+	// mount rather than every access to it.
+	if _, err := dfs.Root(); err != nil {
+		return err
+	}
+	go watchReload(sigCtx, o, dfs)
+	err = mount(sigCtx, o.mountPath, o.pidFile, o.shutdownTimeout, dfs, fc.options)
+	if dfs.Queue != nil {
+		drain(dfs.Queue, o.shutdownTimeout)
+	}
+	return err
+}
+
+// drain waits up to timeout for the pending uploads. Those left are
+// resumed by the next mount.
+func drain(q *writeback.Queue, timeout time.Duration) {
+	n := q.Len()
+	if n == 0 {
+		return
+	}
+	logger.Info("waiting for pending uploads", "count", n)
+	notify(sdnotify.Status(fmt.Sprintf("Waiting for %d pending uploads", n)))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := q.Wait(ctx); err != nil {
+		logger.Warn("pending uploads left for the next mount", "count", q.Len(), "err", err)
+	}
+}
+
+// mount mounts dfs at mnt and serves it until ctx is done or it is
+// unmounted. On shutdown, it waits up to timeout for the file operations in
+// progress.
+func mount(ctx context.Context, mnt, pidFile string, timeout time.Duration, dfs *fusehooks.FS, options []fuse.MountOption) error {
+	if err := cleanStaleMount(mnt); err != nil {
+		return err
+	}
+	c, err := fuse.Mount(mnt, options...)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	served := make(chan error, 1)
+	go func() { served <- fs.Serve(c, dfs) }()
+	// The mount is ready once a stat of the mount point is served.
+	ready := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(mnt)
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case err = <-served:
+		if err == nil {
+			err = errors.New("unmounted while starting")
+		}
+	}
+	if err == nil && pidFile != "" {
+		if err = writePidFile(pidFile); err == nil {
+			defer os.Remove(pidFile)
+		}
+	}
+	if err != nil {
+		_ = fuse.Unmount(mnt)
+		return err
+	}
+	reportMounted(nil)
+	notify(sdnotify.Ready, sdnotify.Status("Serving "+mnt))
+	logger.Info("mounted", "mntpoint", mnt)
+	go superviseMount(ctx, mnt, dfs.Queue)
+
+	select {
+	case err := <-served:
+		// Unmounted from outside, or the connection failed.
+		if err != nil {
+			_ = fuse.Unmount(mnt)
+			logger.Error("serving ended", "err", err)
+		}
+		return nil
+	case <-ctx.Done():
+	}
+
+	logger.Info("shutting down", "mntpoint", mnt)
+	notify(sdnotify.Stopping, sdnotify.Status("Unmounting "+mnt))
+	if err := unmount(mnt); err != nil {
+		logger.Error("unable to unmount", "mntpoint", mnt, "err", err)
+	}
+	// Serve returns once the kernel ends the connection and the
+	// operations in progress are done.
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case err := <-served:
+		if err != nil {
+			logger.Error("serving ended", "err", err)
+		}
+	case <-t.C:
+		logger.Warn("file operations still in progress, closing the connection", "timeout", timeout)
+	}
+	return nil
+}
+
+// serveMetrics serves the metrics of the Default registry over HTTP.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default)
+	logger.Info("serving metrics", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Error("metrics server failed", "addr", addr, "err", err)
+	}
+}
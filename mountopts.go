@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"bazil.org/fuse"
+	"github.com/althk/drivefs/fusehooks"
+)
+
+// mountOptions is the value of -o, a comma-separated list of mount options
+// as taken by mount(8). The flag can be repeated.
+type mountOptions []string
+
+func (m *mountOptions) String() string {
+	return strings.Join(*m, ",")
+}
+
+func (m *mountOptions) Set(v string) error {
+	for _, opt := range strings.Split(v, ",") {
+		if opt = strings.TrimSpace(opt); opt != "" {
+			*m = append(*m, opt)
+		}
+	}
+	return nil
+}
+
+// fuseConfig is how a mount is set up, as given by the mount options.
+type fuseConfig struct {
+	options  []fuse.MountOption
+	perms    fusehooks.Perms
+	readOnly bool
+}
+
+// parseMountOptions parses the mount options. Files are owned by the user
+// running drivefs, and only accessible by them, unless told otherwise.
+func parseMountOptions(opts []string) (*fuseConfig, error) {
+	c := &fuseConfig{perms: fusehooks.Perms{
+		Uid:   uint32(os.Getuid()),
+		Gid:   uint32(os.Getgid()),
+		Umask: 0077,
+	}}
+	fsName, subtype := "drivefs", "drivefs"
+	for _, opt := range opts {
+		key, value := opt, ""
+		if i := strings.Index(opt, "="); i >= 0 {
+			key, value = opt[:i], opt[i+1:]
+		}
+		var err error
+		switch key {
+		case "allow_other":
+			c.options = append(c.options, fuse.AllowOther())
+		case "default_permissions":
+			c.options = append(c.options, fuse.DefaultPermissions())
+		case "ro":
+			c.readOnly = true
+			c.options = append(c.options, fuse.ReadOnly())
+		case "rw":
+			// The default; drivefs only writes with -readwrite.
+		case "fsname":
+			fsName = value
+		case "subtype":
+			subtype = value
+		case "uid":
+			c.perms.Uid, err = parseID(value)
+		case "gid":
+			c.perms.Gid, err = parseID(value)
+		case "umask":
+			var mask uint64
+			mask, err = strconv.ParseUint(value, 8, 32)
+			c.perms.Umask = os.FileMode(mask) & os.ModePerm
+		case "max_readahead":
+			var n uint64
+			n, err = strconv.ParseUint(value, 10, 32)
+			c.options = append(c.options, fuse.MaxReadahead(uint32(n)))
+		default:
+			return nil, fmt.Errorf("unknown mount option %q", opt)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad mount option %q: %w", opt, err)
+		}
+	}
+	c.options = append(c.options, fuse.FSName(fsName), fuse.Subtype(subtype))
+	return c, nil
+}
+
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+)
+
+func TestParseMountOptions(t *testing.T) {
+	var opts mountOptions
+	fs := flag.NewFlagSet("mount", flag.ContinueOnError)
+	fs.Var(&opts, "o", "")
+	if err := fs.Parse([]string{"-o", "allow_other,uid=1000", "-o", "gid=100,umask=022,ro,max_readahead=131072"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(opts) != 6 {
+		t.Fatalf("-o = %q, want 6 options", opts)
+	}
+
+	c, err := parseMountOptions(opts)
+	if err != nil {
+		t.Fatalf("parseMountOptions() error = %v", err)
+	}
+	if c.perms.Uid != 1000 || c.perms.Gid != 100 || c.perms.Umask != 0022 {
+		t.Errorf("perms = %+v, want 1000:100 with umask 022", c.perms)
+	}
+	if !c.readOnly {
+		t.Error("ro did not make the mount read-only")
+	}
+	// allow_other, ro and max_readahead, then fsname and subtype.
+	if len(c.options) != 5 {
+		t.Errorf("got %d FUSE mount options, want 5", len(c.options))
+	}
+
+	c, err = parseMountOptions(nil)
+	if err != nil {
+		t.Fatalf("parseMountOptions(nil) error = %v", err)
+	}
+	if c.perms.Uid != uint32(os.Getuid()) || c.perms.Umask != 0077 || c.readOnly {
+		t.Errorf("default config = %+v, want owned by the current user with umask 077", c)
+	}
+
+	for _, bad := range []string{"uid=me", "umask=999", "nosuchoption", "max_readahead=-1"} {
+		if _, err := parseMountOptions([]string{bad}); err == nil {
+			t.Errorf("parseMountOptions(%q) succeeded", bad)
+		}
+	}
+}
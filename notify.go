@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/althk/drivefs/sdnotify"
+	"github.com/althk/drivefs/writeback"
+)
+
+// statusInterval is how often the status reported to systemd is updated.
+const statusInterval = 10 * time.Second
+
+// notify sends the given states to systemd, if drivefs runs as a
+// Type=notify service.
+func notify(states ...string) {
+	if err := sdnotify.Notify(states...); err != nil {
+		logger.Warn("unable to notify systemd", "err", err)
+	}
+}
+
+// superviseMount keeps systemd informed about the mount at mnt until ctx is
+// done: it updates the status with the pending uploads of q, which may be
+// nil, and pings the watchdog, if enabled, as long as the mount answers.
+func superviseMount(ctx context.Context, mnt string, q *writeback.Queue) {
+	interval := statusInterval
+	watchdog := sdnotify.WatchdogInterval()
+	if watchdog > 0 && watchdog/2 < interval {
+		interval = watchdog / 2
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	last := ""
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		var states []string
+		if status := mountStatus(mnt, q); status != last {
+			states = append(states, sdnotify.Status(status))
+			last = status
+		}
+		// The probe hangs, and the watchdog expires, if serving is
+		// stuck.
+		if watchdog > 0 {
+			if err := probeMount(mnt); err == nil {
+				states = append(states, sdnotify.Watchdog)
+			}
+		}
+		if len(states) > 0 {
+			notify(states...)
+		}
+	}
+}
+
+// probeMount reads .drivefs/config from the mount at mnt. Control files
+// are opened with direct I/O and generated without calling Drive, so
+// unlike a stat, which the kernel may answer from its attribute cache, the
+// read is served by drivefs every time, and only depends on it.
+func probeMount(mnt string) error {
+	_, err := os.ReadFile(filepath.Join(mnt, ".drivefs", "config"))
+	return err
+}
+
+// mountStatus describes how the mount at mnt is doing.
+func mountStatus(mnt string, q *writeback.Queue) string {
+	var items []writeback.Item
+	if q != nil {
+		items = q.Items()
+	}
+	if len(items) == 0 {
+		return "Serving " + mnt
+	}
+	for _, it := range items {
+		if it.LastError != "" {
+			return fmt.Sprintf("Serving %s, %d uploads pending, offline or failing: %s", mnt, len(items), it.LastError)
+		}
+	}
+	return fmt.Sprintf("Serving %s, syncing %d changes", mnt, len(items))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/althk/drivefs/logging"
+)
+
+func TestSuperviseMount(t *testing.T) {
+	logger = logging.New(io.Discard, logging.LevelError, logging.FormatText)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "notify")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	os.Setenv("NOTIFY_SOCKET", path)
+	os.Setenv("WATCHDOG_USEC", "100000")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go superviseMount(ctx, dir, nil)
+
+	l.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	read := func() string {
+		n, err := l.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+	// The watchdog is not pinged until the mount serves its control files.
+	if got, want := read(), "STATUS=Serving "+dir+"\n"; got != want {
+		t.Errorf("message = %q, want %q", got, want)
+	}
+	if err := os.Mkdir(filepath.Join(dir, ".drivefs"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".drivefs", "config"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The status is only sent again when it changes.
+	if got, want := read(), "WATCHDOG=1\n"; got != want {
+		t.Errorf("message = %q, want %q", got, want)
+	}
+}
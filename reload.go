@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/althk/drivefs/driveapi"
+	"github.com/althk/drivefs/fusehooks"
+	"github.com/althk/drivefs/logging"
+	"github.com/althk/drivefs/sdnotify"
+)
+
+// watchReload reloads the configuration of the mount on SIGHUP until ctx
+// is done.
+func watchReload(ctx context.Context, o *options, dfs *fusehooks.FS) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	running := make(map[string]string, len(o.values))
+	for k, v := range o.values {
+		running[k] = v
+	}
+	for {
+		select {
+		case <-hup:
+		case <-ctx.Done():
+			return
+		}
+		logger.Info("reloading the configuration")
+		notify(sdnotify.Reloading)
+		n, _, _, err := parseFlags(commandNamed("mount"), o.args, flag.ContinueOnError)
+		if err != nil {
+			logger.Error("unable to reload the configuration", "err", err)
+		} else if remount := reload(running, n.values, dfs); len(remount) > 0 {
+			logger.Warn("settings changed that take effect on the next mount", "settings", remount)
+		}
+		notify(sdnotify.Ready)
+	}
+}
+
+// reload applies the settings of values that differ from the running ones
+// and can change while mounted, updating running. It returns the names of
+// the other changed settings, which need a remount.
+func reload(running, values map[string]string, dfs *fusehooks.FS) (remount []string) {
+	for k, v := range values {
+		if running[k] == v {
+			continue
+		}
+		var err error
+		switch k {
+		case "loglevel":
+			var level logging.Level
+			if level, err = logging.ParseLevel(v); err == nil {
+				logger.SetLevel(level)
+			}
+		case "cachesize":
+			var size int64
+			if size, err = strconv.ParseInt(v, 10, 64); err == nil && dfs.Cache != nil {
+				dfs.Cache.SetBudget(size << 20)
+			}
+		case "listttl":
+			var ttl time.Duration
+			if ttl, err = time.ParseDuration(v); err == nil {
+				driveapi.SetListTTL(ttl)
+			}
+		default:
+			remount = append(remount, k)
+			continue
+		}
+		if err != nil {
+			logger.Error("unable to apply setting", "setting", k, "value", v, "err", err)
+			continue
+		}
+		logger.Info("setting changed", "setting", k, "from", running[k], "to", v)
+		running[k] = v
+	}
+	sort.Strings(remount)
+	return remount
+}
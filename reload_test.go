@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/althk/drivefs/cache"
+	"github.com/althk/drivefs/driveapi"
+	"github.com/althk/drivefs/fusehooks"
+	"github.com/althk/drivefs/logging"
+)
+
+func TestReload(t *testing.T) {
+	logger = logging.New(io.Discard, logging.LevelInfo, logging.FormatText)
+	dfs := &fusehooks.FS{Cache: cache.New(256 << 20)}
+	running := map[string]string{
+		"loglevel": "info", "cachesize": "256", "readwrite": "false", "chunksize": "8", "listttl": "1h0m0s",
+	}
+	values := map[string]string{
+		"loglevel": "debug", "cachesize": "512", "readwrite": "true", "chunksize": "8", "listttl": "5m0s",
+	}
+	defer driveapi.SetListTTL(driveapi.DefaultListTTL)
+
+	remount := reload(running, values, dfs)
+	if want := []string{"readwrite"}; !reflect.DeepEqual(remount, want) {
+		t.Errorf("reload() = %q, want %q", remount, want)
+	}
+	if logger.Level() != logging.LevelDebug {
+		t.Errorf("log level = %v, want debug", logger.Level())
+	}
+	if got := dfs.Cache.Budget(); got != 512<<20 {
+		t.Errorf("cache budget = %d, want %d", got, 512<<20)
+	}
+	if running["cachesize"] != "512" || running["listttl"] != "5m0s" || running["readwrite"] != "false" {
+		t.Errorf("running = %v, want the applied settings only", running)
+	}
+
+	// A bad value is not applied, and tried again on the next reload.
+	values["loglevel"] = "loud"
+	if remount := reload(running, values, dfs); len(remount) != 1 {
+		t.Errorf("reload() = %q, want only readwrite", remount)
+	}
+	if logger.Level() != logging.LevelDebug || running["loglevel"] != "debug" {
+		t.Errorf("bad log level was applied")
+	}
+}
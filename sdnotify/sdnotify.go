@@ -0,0 +1,70 @@
+// Package sdnotify tells systemd about the state of a service, as
+// sd_notify(3) does, for units of Type=notify:
+//
+//	sdnotify.Notify(sdnotify.Ready, sdnotify.Status("mounted"))
+//
+// Messages are sent as datagrams to the unix socket named by the
+// NOTIFY_SOCKET environment variable. Without it, as when not run by
+// systemd, they are dropped.
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// States understood by systemd.
+const (
+	// Ready tells that the service finished starting up.
+	Ready = "READY=1"
+	// Reloading tells that the service reloads its configuration. Ready
+	// must be sent once it is done.
+	Reloading = "RELOADING=1"
+	// Stopping tells that the service is shutting down.
+	Stopping = "STOPPING=1"
+	// Watchdog keeps the watchdog of the service from expiring.
+	Watchdog = "WATCHDOG=1"
+)
+
+// Status returns the state giving a one line description of how the
+// service is doing, shown by systemctl status.
+func Status(s string) string {
+	return "STATUS=" + strings.ReplaceAll(s, "\n", " ")
+}
+
+// Notify sends the given states, such as Ready, to systemd in a single
+// message. It does nothing if NOTIFY_SOCKET is not set.
+func Notify(states ...string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// A leading @ names a socket in the abstract namespace.
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write([]byte(strings.Join(states, "\n") + "\n"))
+	return err
+}
+
+// WatchdogInterval returns how often systemd expects Watchdog, as set by
+// WatchdogSec= in the unit, or 0 if the watchdog is disabled for this
+// process.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
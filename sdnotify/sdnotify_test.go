@@ -0,0 +1,71 @@
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// setenv sets an environment variable until the test ends.
+func setenv(t *testing.T, key, value string) {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	setenv(t, "NOTIFY_SOCKET", path)
+
+	if err := Notify(Ready, Status("mounted\nat /mnt")); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+	l.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := l.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf[:n]), "READY=1\nSTATUS=mounted at /mnt\n"; got != want {
+		t.Errorf("message = %q, want %q", got, want)
+	}
+
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := Notify(Ready); err != nil {
+		t.Errorf("Notify() without NOTIFY_SOCKET error = %v", err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	setenv(t, "WATCHDOG_USEC", "")
+	setenv(t, "WATCHDOG_PID", "")
+	if got := WatchdogInterval(); got != 0 {
+		t.Errorf("WatchdogInterval() unset = %v, want 0", got)
+	}
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	if got := WatchdogInterval(); got != 30*time.Second {
+		t.Errorf("WatchdogInterval() = %v, want 30s", got)
+	}
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if got := WatchdogInterval(); got != 30*time.Second {
+		t.Errorf("WatchdogInterval() for this process = %v, want 30s", got)
+	}
+	os.Setenv("WATCHDOG_PID", "1")
+	if got := WatchdogInterval(); got != 0 {
+		t.Errorf("WatchdogInterval() for another process = %v, want 0", got)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// unmount unmounts mnt, detaching it lazily if it is busy: it disappears
+// from the file system at once, and the kernel ends the FUSE connection
+// once the processes using it let go.
+func unmount(mnt string) error {
+	err := fuse.Unmount(mnt)
+	if err == nil {
+		return nil
+	}
+	logger.Warn("unmount failed, detaching lazily", "mntpoint", mnt, "err", err)
+	return lazyUnmount(mnt)
+}
+
+// lazyUnmount detaches mnt without waiting for it to be unused.
+func lazyUnmount(mnt string) error {
+	cmd := exec.Command("fusermount", "-u", "-z", mnt)
+	if runtime.GOOS != "linux" {
+		cmd = exec.Command("umount", "-f", mnt)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if out = bytes.TrimSpace(out); len(out) > 0 {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+		return err
+	}
+	return nil
+}
+
+// cleanStaleMount unmounts mnt if it is left mounted by a FUSE server that
+// is gone, such as a drivefs process that was killed, which makes it fail
+// with "transport endpoint is not connected".
+func cleanStaleMount(mnt string) error {
+	if _, err := os.Stat(mnt); !errors.Is(err, syscall.ENOTCONN) {
+		return nil
+	}
+	logger.Warn("cleaning up stale mount", "mntpoint", mnt)
+	if err := lazyUnmount(mnt); err != nil {
+		return fmt.Errorf("unable to clean up stale mount at %v: %w", mnt, err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/althk/drivefs/logging"
+)
+
+func TestUnmount_Busy(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("lazy unmount uses fusermount on Linux only")
+	}
+	logger = logging.New(io.Discard, logging.LevelError, logging.FormatText)
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	// A fusermount that fails to unmount a busy mount unless lazily.
+	err := os.WriteFile(filepath.Join(dir, "fusermount"), []byte(`#!/bin/sh
+echo "$@" >> `+calls+`
+[ "$2" = -z ] && exit 0
+echo "fusermount: failed to unmount $2: Device or resource busy" >&2
+exit 1
+`), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	if err := unmount("/mnt/drive"); err != nil {
+		t.Fatalf("unmount() error = %v", err)
+	}
+	b, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "-u /mnt/drive\n-u -z /mnt/drive\n"
+	if string(b) != want {
+		t.Errorf("fusermount calls = %q, want %q", b, want)
+	}
+
+	// A mount point that is not stale is left alone.
+	if err := cleanStaleMount(dir); err != nil {
+		t.Errorf("cleanStaleMount() error = %v", err)
+	}
+	if b, _ := os.ReadFile(calls); strings.Count(string(b), "\n") != 2 {
+		t.Errorf("cleanStaleMount() ran fusermount on a working dir: %q", b)
+	}
+}
@@ -0,0 +1,519 @@
+// Package writeback uploads the files written through the mount in the
+// background.
+//
+// A closed file is moved into the queue dir along with a JSON record
+// describing where it goes on Drive, and uploaded by a pool of workers that
+// retry failed uploads with backoff. Both are synced to disk before the
+// file is considered queued, so pending uploads survive a crash and are
+// picked up again by the next Open of the same dir.
+package writeback
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/althk/drivefs/driveapi"
+	"github.com/althk/drivefs/logging"
+	"github.com/althk/drivefs/metrics"
+)
+
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = 10 * time.Minute
+)
+
+var failedAttempts = metrics.NewCounter("drivefs_writeback_failed_attempts_total",
+	"Background upload attempts that failed and are retried later.")
+
+// logger is where the package logs to. See SetLogger.
+var logger *logging.Logger
+
+// SetLogger sets the logger of the package. Nothing is logged until it is
+// set.
+func SetLogger(l *logging.Logger) {
+	logger = l
+}
+
+// Item is a file waiting to be uploaded.
+type Item struct {
+	ID       string
+	Key      string
+	Target   driveapi.UploadTarget
+	Size     int64
+	Queued   time.Time
+	Attempts int
+	// LastError is the error of the last failed attempt, if any.
+	LastError   string
+	NextAttempt time.Time
+
+	file    driveapi.File // nil for items loaded from disk
+	started bool          // whether a worker is uploading the item
+}
+
+// Key returns the key identifying the uploads of file in the queue.
+func Key(file driveapi.File) string {
+	if file.ID() != "" {
+		return file.ID()
+	}
+	return file.ParentID() + "/" + file.Name()
+}
+
+// Queue is a durable queue of files to upload.
+type Queue struct {
+	dir      string
+	uploader *driveapi.Uploader
+
+	mu    sync.Mutex
+	items map[string]*Item // by ID
+	seq   int64
+	wake  chan struct{}
+	// changed is signaled whenever an upload attempt finishes.
+	changed *sync.Cond
+	// moved is the last change of head revision made by an upload, by key.
+	moved map[string]move
+}
+
+// move is a change of the head revision of a file on Drive.
+type move struct {
+	from, to string
+}
+
+// Open opens the queue kept in dir, creating the dir if needed, and loads
+// the items left pending by a previous run.
+func Open(dir string, u *driveapi.Uploader) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	q := &Queue{
+		dir:      dir,
+		uploader: u,
+		items:    make(map[string]*Item),
+		wake:     make(chan struct{}, 1),
+		moved:    make(map[string]move),
+	}
+	q.changed = sync.NewCond(&q.mu)
+	items, err := Pending(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i := range items {
+		it := items[i]
+		it.NextAttempt = time.Time{}
+		q.items[it.ID] = &it
+	}
+	return q, nil
+}
+
+// Pending returns the items queued in dir, oldest first.
+func Pending(dir string) ([]Item, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var items []Item
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		var it Item
+		if err := json.Unmarshal(b, &it); err != nil {
+			logger.Warn("skipping corrupt upload queue record", "path", p, "err", err)
+			continue
+		}
+		items = append(items, it)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	return items, nil
+}
+
+func (q *Queue) dataPath(id string) string {
+	return filepath.Join(q.dir, id+".data")
+}
+
+func (q *Queue) recordPath(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+// Enqueue moves the local file at path into the queue, to be uploaded as
+// the content of file. baseRevision is the revision of the file on Drive
+// the content derives from, which must still be the head revision when the
+// content is uploaded, or else it goes to a conflict copy. A pending upload
+// of the same file that no worker has started yet is superseded by the new
+// one.
+func (q *Queue) Enqueue(file driveapi.File, path, baseRevision string) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.seq++
+	key := Key(file)
+	it := &Item{
+		ID:  fmt.Sprintf("%d-%06d", time.Now().UnixNano(), q.seq),
+		Key: key,
+		Target: driveapi.UploadTarget{
+			FileID:       file.ID(),
+			Name:         file.Name(),
+			ParentID:     file.ParentID(),
+			MimeType:     file.MimeType(),
+			BaseRevision: q.rebase(key, baseRevision),
+		},
+		Size:   st.Size(),
+		Queued: time.Now(),
+		file:   file,
+	}
+	if err := os.Rename(path, q.dataPath(it.ID)); err != nil {
+		return err
+	}
+	if err := q.save(it); err != nil {
+		os.Rename(q.dataPath(it.ID), path)
+		return err
+	}
+	if err := syncDir(q.dir); err != nil {
+		return err
+	}
+	for _, old := range q.items {
+		if old.Key == it.Key && !old.started {
+			q.drop(old)
+		}
+	}
+	q.items[it.ID] = it
+	q.signal()
+	return nil
+}
+
+// Lookup returns the newest queued content of file and the path it is
+// kept at.
+func (q *Queue) Lookup(file driveapi.File) (path string, it Item, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if latest := q.latest(Key(file)); latest != nil {
+		return q.dataPath(latest.ID), *latest, true
+	}
+	return "", Item{}, false
+}
+
+// Rebase returns the revision that content derived from baseRevision of
+// the file with the given key derives from now: if the last upload of the
+// file was based on it too, the head revision that upload made.
+func (q *Queue) Rebase(key, baseRevision string) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.rebase(key, baseRevision)
+}
+
+// rebase is Rebase with q.mu held.
+func (q *Queue) rebase(key, baseRevision string) string {
+	if m, ok := q.moved[key]; ok && m.from == baseRevision {
+		return m.to
+	}
+	return baseRevision
+}
+
+// Items returns a snapshot of the pending uploads, oldest first.
+func (q *Queue) Items() []Item {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := make([]Item, 0, len(q.items))
+	for _, it := range q.items {
+		items = append(items, *it)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	return items
+}
+
+// Len returns the number of pending uploads.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// Start starts n upload workers, which run until ctx is done.
+func (q *Queue) Start(ctx context.Context, n int) {
+	for i := 0; i < n; i++ {
+		go q.work(ctx)
+	}
+}
+
+// Wait blocks until the queue is empty or ctx is done.
+func (q *Queue) Wait(ctx context.Context) error {
+	return q.wait(ctx, func() (bool, error) {
+		return len(q.items) == 0, nil
+	})
+}
+
+// WaitKey blocks until all the uploads queued with the given key are done.
+// It fails if any of them fails an attempt meanwhile, even though it keeps
+// being retried in the background.
+func (q *Queue) WaitKey(ctx context.Context, key string) error {
+	q.mu.Lock()
+	attempts := make(map[string]int)
+	for id, it := range q.items {
+		if it.Key == key {
+			attempts[id] = it.Attempts
+		}
+	}
+	q.mu.Unlock()
+	return q.wait(ctx, func() (bool, error) {
+		done := true
+		for id, it := range q.items {
+			if it.Key != key {
+				continue
+			}
+			if n, ok := attempts[id]; ok && it.Attempts > n || !ok && it.Attempts > 0 {
+				return true, fmt.Errorf("upload of %s failed: %s", it.Target.Name, it.LastError)
+			}
+			done = false
+		}
+		return done, nil
+	})
+}
+
+// wait blocks until cond, which is called with q.mu held, reports done.
+func (q *Queue) wait(ctx context.Context, cond func() (bool, error)) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			q.mu.Lock()
+			q.changed.Broadcast()
+			q.mu.Unlock()
+		case <-stop:
+		}
+	}()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if done, err := cond(); done || err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		q.changed.Wait()
+	}
+}
+
+func (q *Queue) work(ctx context.Context) {
+	for {
+		it, wait := q.next()
+		if it == nil {
+			t := time.NewTimer(wait)
+			select {
+			case <-q.wake:
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return
+			}
+			t.Stop()
+			continue
+		}
+		start := time.Now()
+		rev, err := q.upload(ctx, it)
+		q.finish(it, start, rev, err)
+	}
+}
+
+// next returns the oldest item ready to be uploaded and marks it as
+// started. Items of a file are uploaded one at a time, in order. If no
+// item is ready, next returns how long to wait before trying again.
+func (q *Queue) next() (*Item, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	busy := make(map[string]bool)
+	for _, it := range q.items {
+		if it.started {
+			busy[it.Key] = true
+		}
+	}
+	var best *Item
+	wait := maxRetryDelay
+	now := time.Now()
+	for _, it := range q.items {
+		if it.started || busy[it.Key] {
+			continue
+		}
+		if d := it.NextAttempt.Sub(now); d > 0 {
+			if d < wait {
+				wait = d
+			}
+			continue
+		}
+		if best == nil || it.ID < best.ID {
+			best = it
+		}
+	}
+	if best != nil {
+		best.started = true
+	}
+	return best, wait
+}
+
+// upload uploads an item against its base revision and returns the new head
+// revision of the file, which is empty if the content went to a conflict
+// copy.
+func (q *Queue) upload(ctx context.Context, it *Item) (string, error) {
+	path := q.dataPath(it.ID)
+	if it.file != nil {
+		return it.file.Upload(ctx, q.uploader, path, it.Target.BaseRevision)
+	}
+	res, err := q.uploader.Upload(ctx, it.Target, path)
+	if err != nil {
+		return "", err
+	}
+	q.mu.Lock()
+	q.created(it, res.Id)
+	q.mu.Unlock()
+	if it.Target.FileID != "" && res.Id != it.Target.FileID {
+		return "", nil
+	}
+	return res.HeadRevisionId, nil
+}
+
+// finish records the outcome of an upload attempt started at start, which
+// made rev the head revision of the file if it succeeded.
+func (q *Queue) finish(it *Item, start time.Time, rev string, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	it.started = false
+	if _, ok := q.items[it.ID]; !ok {
+		return
+	}
+	if err == nil {
+		logger.Info("uploaded", "op", "upload", "file", it.Target.FileID,
+			"name", it.Target.Name, "size", it.Size, "latency", time.Since(start))
+		if it.file != nil {
+			q.created(it, it.file.ID())
+		}
+		q.uploaded(it, rev)
+		q.drop(it)
+		q.signal()
+		return
+	}
+	it.Attempts++
+	it.LastError = err.Error()
+	failedAttempts.Inc()
+	delay := minRetryDelay << uint(it.Attempts-1)
+	if delay > maxRetryDelay || delay <= 0 {
+		delay = maxRetryDelay
+	}
+	it.NextAttempt = time.Now().Add(delay)
+	logger.Warn("upload failed, retrying", "op", "upload", "file", it.Target.FileID,
+		"name", it.Target.Name, "attempt", it.Attempts, "retry_in", delay,
+		"latency", time.Since(start), "err", err)
+	if err := q.save(it); err != nil {
+		logger.Error("unable to update upload queue record", "id", it.ID, "err", err)
+	}
+	q.changed.Broadcast()
+	q.signal()
+}
+
+// created points the other pending uploads of a new file to the Drive file
+// that the upload of it created, so they update it instead of creating
+// more copies. Must be called with q.mu held.
+func (q *Queue) created(it *Item, fileID string) {
+	if it.Target.FileID != "" {
+		return
+	}
+	for _, other := range q.items {
+		if other != it && other.Key == it.Key && other.Target.FileID == "" {
+			other.Target.FileID = fileID
+			if err := q.save(other); err != nil {
+				logger.Error("unable to update upload queue record", "id", other.ID, "err", err)
+			}
+		}
+	}
+}
+
+// uploaded moves the later pending uploads of the same file on to rev, the
+// head revision the upload of it made, as their content was written after
+// it. If it went to a conflict copy instead, they are left to do so as
+// well. Must be called with q.mu held.
+func (q *Queue) uploaded(it *Item, rev string) {
+	if rev == "" {
+		return
+	}
+	q.moved[it.Key] = move{from: it.Target.BaseRevision, to: rev}
+	for _, other := range q.items {
+		if other.Key != it.Key || other.ID <= it.ID {
+			continue
+		}
+		other.Target.BaseRevision = rev
+		if err := q.save(other); err != nil {
+			logger.Error("unable to update upload queue record", "id", other.ID, "err", err)
+		}
+	}
+}
+
+// latest returns the newest item with the given key. Must be called with
+// q.mu held.
+func (q *Queue) latest(key string) *Item {
+	var latest *Item
+	for _, it := range q.items {
+		if it.Key == key && (latest == nil || it.ID > latest.ID) {
+			latest = it
+		}
+	}
+	return latest
+}
+
+// drop removes an item and its files. Must be called with q.mu held.
+func (q *Queue) drop(it *Item) {
+	delete(q.items, it.ID)
+	os.Remove(q.recordPath(it.ID))
+	os.Remove(q.dataPath(it.ID))
+	q.changed.Broadcast()
+}
+
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// save writes the record of an item durably.
+func (q *Queue) save(it *Item) error {
+	b, err := json.MarshalIndent(it, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := q.recordPath(it.ID)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
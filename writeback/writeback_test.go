@@ -0,0 +1,204 @@
+package writeback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/althk/drivefs/driveapi"
+)
+
+// fakeFile records the content uploaded for it and the revisions the
+// uploads were based on. Uploads fail while fail is positive.
+type fakeFile struct {
+	driveapi.File
+	id, name string
+
+	mu       sync.Mutex
+	fail     int
+	uploaded []string
+	bases    []string
+}
+
+func (f *fakeFile) ID() string       { return f.id }
+func (f *fakeFile) Name() string     { return f.name }
+func (f *fakeFile) ParentID() string { return "root" }
+func (f *fakeFile) MimeType() string { return "text/plain" }
+
+func (f *fakeFile) HeadRevisionID() string { return "" }
+
+func (f *fakeFile) Upload(_ context.Context, _ *driveapi.Uploader, path, baseRevision string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail > 0 {
+		f.fail--
+		return "", errors.New("network is unreachable")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	f.uploaded = append(f.uploaded, string(b))
+	f.bases = append(f.bases, baseRevision)
+	return fmt.Sprintf("r%d", len(f.uploaded)+1), nil
+}
+
+func writeTemp(t *testing.T, dir, content string) string {
+	f, err := os.CreateTemp(dir, "stage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestQueue_EnqueueAndUpload(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(filepath.Join(dir, "queue"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeFile{id: "fid1", name: "a.txt", fail: 1}
+	if err := q.Enqueue(f, writeTemp(t, dir, "v1"), ""); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	// Superseded by the next one before any worker started.
+	if err := q.Enqueue(f, writeTemp(t, dir, "v2"), ""); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	path, it, ok := q.Lookup(f)
+	if !ok || it.Size != 2 {
+		t.Fatalf("Lookup() = %q, %+v, %v", path, it, ok)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "v2" {
+		t.Errorf("queued content = %q, want %q", b, "v2")
+	}
+	if items, _ := Pending(q.dir); len(items) != 1 {
+		t.Errorf("Pending() = %d records on disk, want 1", len(items))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	q.Start(ctx, 2)
+	if err := q.Wait(ctx); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.uploaded) != 1 || f.uploaded[0] != "v2" {
+		t.Errorf("uploaded %q, want [v2]", f.uploaded)
+	}
+	if entries, _ := os.ReadDir(q.dir); len(entries) != 0 {
+		t.Errorf("queue dir not empty after upload: %v", entries)
+	}
+}
+
+func TestQueue_ReloadPending(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeFile{name: "new.txt"}
+	if err := q.Enqueue(f, writeTemp(t, t.TempDir(), "data"), ""); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	q2, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := q2.Items()
+	if len(items) != 1 {
+		t.Fatalf("reopened queue has %d items, want 1", len(items))
+	}
+	want := driveapi.UploadTarget{Name: "new.txt", ParentID: "root", MimeType: "text/plain"}
+	if items[0].Target != want || items[0].Size != 4 {
+		t.Errorf("reloaded item = %+v, want target %+v", items[0], want)
+	}
+}
+
+func TestQueue_WaitKey(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(filepath.Join(dir, "queue"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeFile{id: "fid3", name: "c.txt", fail: 1}
+	if err := q.Enqueue(f, writeTemp(t, dir, "v1"), ""); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	q.Start(ctx, 1)
+
+	if err := q.WaitKey(ctx, Key(f)); err == nil {
+		t.Fatal("WaitKey() after a failed attempt error = nil")
+	}
+	// The failed upload is retried, and waiting again sees it through.
+	if err := q.WaitKey(ctx, Key(f)); err != nil {
+		t.Fatalf("WaitKey() error = %v", err)
+	}
+	if q.Len() != 0 || len(f.uploaded) != 1 {
+		t.Errorf("after WaitKey() queue has %d items, uploaded %q", q.Len(), f.uploaded)
+	}
+	if err := q.WaitKey(ctx, "unknown"); err != nil {
+		t.Errorf("WaitKey() with nothing queued error = %v", err)
+	}
+}
+
+func TestQueue_BaseRevision(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(filepath.Join(dir, "queue"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeFile{id: "fid4", name: "d.txt"}
+	if err := q.Enqueue(f, writeTemp(t, dir, "v1"), "r1"); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	first, _ := q.next()
+	// Not superseded, as the first upload is under way.
+	if err := q.Enqueue(f, writeTemp(t, dir, "v2"), "r1"); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	rev, err := q.upload(context.TODO(), first)
+	q.finish(first, time.Now(), rev, err)
+	if err != nil || rev != "r2" {
+		t.Fatalf("upload() = %q, %v, want r2", rev, err)
+	}
+
+	// The later upload is based on the revision the first one made, on
+	// disk too.
+	items, err := Pending(q.dir)
+	if err != nil || len(items) != 1 || items[0].Target.BaseRevision != "r2" {
+		t.Fatalf("Pending() = %+v, %v, want one item based on r2", items, err)
+	}
+	// So is content derived from the same revision queued afterwards.
+	if got := q.Rebase(Key(f), "r1"); got != "r2" {
+		t.Errorf("Rebase(r1) = %q, want r2", got)
+	}
+	if err := q.Enqueue(f, writeTemp(t, dir, "v3"), "r1"); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	q.Start(ctx, 1)
+	if err := q.Wait(ctx); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if want := []string{"r1", "r2"}; !reflect.DeepEqual(f.bases, want) {
+		t.Errorf("uploads based on %q, want %q", f.bases, want)
+	}
+}